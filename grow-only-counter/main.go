@@ -4,15 +4,70 @@ import (
 	"context"
 	"encoding/json"
 	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
 )
 
 var node *maelstrom.Node
-var counter int = 0
 var kv maelstrom.KV
 
+// named counters, requests without a key use default_key
+const default_key string = "counter"
+
+/*
+Every named counter is a G-Counter: counters[key][origin] is the total that origin node has added.
+The value of a counter is the sum over all origins, merging two states takes the max per origin.
+
+Adds are not sent one by one. Every gossip_interval a node ships each peer the delta-state,
+the entries that peer has not acknowledged yet. The per origin counts in a delta act as its
+causal context, a receiver joins them with max so a duplicated or reordered delta is applied
+exactly once. A lost gossip or ack needs no retry, acked is not advanced so the next round
+ships the same entries again joined with everything added since.
+*/
+type state map[string]map[string]int
+
+var rw sync.RWMutex
+var counters state = make(state)
+
+// acked[peer] is the part of counters that peer is known to have
+var acked map[string]state = make(map[string]state)
+
+const gossip_interval = 250 * time.Millisecond
+
+/*
+Durability: a node keeps its whole state (counters and escrow rights) in SeqKV under state_<node id>.
+Every change goes through commit, which writes the new state to SeqKV before it becomes
+visible locally. Whatever a node has replied with is durable, so a restart never makes a
+counter go backwards. Only this node writes its record and commits are serialized by
+persist_mu, so a plain write is enough.
+
+On startup the node loads its record and joins the state of its peers. Until that is done
+every request is answered with a temporarily-unavailable error.
+*/
+var persist_mu sync.Mutex
+var ready bool = false
+
+const recovery_timeout = 500 * time.Millisecond
+
+var err_recovering = maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable, "node is recovering its state")
+
+/*
+Bounded counter mode, enabled by setting COUNTER_BOUND.
+
+Every named counter is capped at bound. The headroom is split into escrow rights,
+each node starts with an equal share and spends its rights on local adds.
+A node that runs out of rights asks peers to transfer some of theirs,
+the granter gives up its rights before replying so a right is never held twice.
+A lost transfer reply only loses headroom, it can never oversell.
+*/
+var bound int = 0
+var rights map[string]int = make(map[string]int)
+
 /*
 -----------
    Utils
@@ -28,39 +83,291 @@ func get_body_from_msg(msg maelstrom.Message) (map[string]any, error) {
 	return body, nil
 }
 
-func propagate(body map[string]any) {
-	body["type"] = "propagate"
+func get_key(body map[string]any) string {
+	key, ok := body["key"].(string)
+	if !ok || key == "" {
+		return default_key
+	}
+	return key
+}
+
+// converts a state decoded from a json body
+func get_state_from_body(raw any) state {
+	result := make(state)
+	for key, entries := range raw.(map[string]any) {
+		result[key] = make(map[string]int)
+		for origin, count := range entries.(map[string]any) {
+			result[key][origin] = int(count.(float64))
+		}
+	}
+	return result
+}
+
+// joins other into s, taking the max per origin. returns true if s changed
+func (s state) join(other state) bool {
+	changed := false
+	for key, entries := range other {
+		if _, ok := s[key]; !ok {
+			s[key] = make(map[string]int)
+		}
+		for origin, count := range entries {
+			if count > s[key][origin] {
+				s[key][origin] = count
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// entries of s that are ahead of other
+func (s state) delta(other state) state {
+	result := make(state)
+	for key, entries := range s {
+		for origin, count := range entries {
+			if count > other[key][origin] {
+				if _, ok := result[key]; !ok {
+					result[key] = make(map[string]int)
+				}
+				result[key][origin] = count
+			}
+		}
+	}
+	return result
+}
+
+func (s state) copy() state {
+	result := make(state)
+	result.join(s)
+	return result
+}
+
+func (s state) add(key string, origin string, delta int) {
+	if _, ok := s[key]; !ok {
+		s[key] = make(map[string]int)
+	}
+	s[key][origin] += delta
+}
+
+func get_rights_from_body(raw any) map[string]int {
+	result := make(map[string]int)
+	for key, value := range raw.(map[string]any) {
+		result[key] = int(value.(float64))
+	}
+	return result
+}
+
+/*
+Applies update to a copy of the local state, writes the copy to SeqKV and only then
+swaps it in. If update or the write fails local state is left untouched.
+*/
+func commit(update func(next_counters state, next_rights map[string]int) error) error {
+	persist_mu.Lock()
+	defer persist_mu.Unlock()
+
+	rw.RLock()
+	next_counters := counters.copy()
+	next_rights := make(map[string]int)
+	for key, value := range rights {
+		next_rights[key] = value
+	}
+	rw.RUnlock()
+
+	err := update(next_counters, next_rights)
+	if err != nil {
+		return err
+	}
+
+	record := make(map[string]any)
+	record["counters"] = next_counters
+	record["rights"] = next_rights
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	err = kv.Write(ctx, "state_"+node.ID(), record)
+	if err != nil {
+		return err
+	}
+
+	rw.Lock()
+	counters = next_counters
+	rights = next_rights
+	rw.Unlock()
+	return nil
+}
+
+func is_ready() bool {
+	rw.RLock()
+	defer rw.RUnlock()
+	return ready
+}
+
+// rebuilds state from the SeqKV record of this node and the state of its peers
+func recover_state() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		value, err := kv.Read(ctx, "state_"+node.ID())
+		cancel()
+		if err == nil {
+			record := value.(map[string]any)
+			persist_mu.Lock()
+			rw.Lock()
+			counters = get_state_from_body(record["counters"])
+			rights = get_rights_from_body(record["rights"])
+			rw.Unlock()
+			persist_mu.Unlock()
+			break
+		}
+		if maelstrom.ErrorCode(err) == maelstrom.KeyDoesNotExist {
+			// first start of this node
+			break
+		}
+	}
+
+	var wg sync.WaitGroup
+	var peers_mu sync.Mutex
+	peer_state := make(state)
 	for _, vertex := range node.NodeIDs() {
 		if vertex == node.ID() {
 			continue
 		}
+		wg.Add(1)
 		go func() {
-			for {
-				ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
-				defer cancel()
-				_, err := node.SyncRPC(ctx, vertex, body)
-				if err != nil {
-					// RPC failed/timed out, retry.
-				} else {
-					// SUCCESS
-					return
-				}
+			defer wg.Done()
+			body := make(map[string]any)
+			body["type"] = "read_state"
+			ctx, cancel := context.WithTimeout(context.Background(), recovery_timeout)
+			defer cancel()
+			resp, err := node.SyncRPC(ctx, vertex, body)
+			if err != nil {
+				// peer unreachable, its entries arrive with gossip later
+				return
+			}
+			resp_body, err := get_body_from_msg(resp)
+			if err != nil {
+				return
 			}
+			peers_mu.Lock()
+			peer_state.join(get_state_from_body(resp_body["counters"]))
+			peers_mu.Unlock()
 		}()
 	}
+	wg.Wait()
+
+	for {
+		err := commit(func(next_counters state, next_rights map[string]int) error {
+			next_counters.join(peer_state)
+			return nil
+		})
+		if err == nil {
+			break
+		}
+	}
+
+	rw.Lock()
+	ready = true
+	rw.Unlock()
+	log.Printf("Node %s recovered", node.ID())
+}
+
+func gossip() {
+	for _, vertex := range node.NodeIDs() {
+		if vertex == node.ID() {
+			continue
+		}
+
+		rw.Lock()
+		if _, ok := acked[vertex]; !ok {
+			acked[vertex] = make(state)
+		}
+		delta := counters.delta(acked[vertex])
+		rw.Unlock()
+		if len(delta) == 0 {
+			continue
+		}
+
+		body := make(map[string]any)
+		body["type"] = "gossip"
+		body["delta"] = delta
+		node.RPC(vertex, body, func(msg maelstrom.Message) error {
+			// error replies also land here, only a gossip_ok means the peer made delta durable
+			if msg.RPCError() != nil || msg.Type() != "gossip_ok" {
+				return nil
+			}
+			rw.Lock()
+			if _, ok := acked[vertex]; ok {
+				acked[vertex].join(delta)
+			}
+			rw.Unlock()
+			return nil
+		})
+	}
 }
 
-func add_delta(delta int) {
-	/*
-	 Write to SeqKV store in backgroud, and update counter to ensure it contains updated state.
-	 local var counter is like in-mem cache. Updating it ensures immediate reads are not stale
-	*/
-	go func(from int, to int) {
+// initial escrow share of this node, remainder of the split goes to the first nodes
+func get_share() int {
+	ids := node.NodeIDs()
+	share := bound / len(ids)
+	for i, id := range ids {
+		if id == node.ID() && i < bound%len(ids) {
+			share++
+		}
+	}
+	return share
+}
+
+func init_rights(rights map[string]int, key string) {
+	if _, ok := rights[key]; !ok {
+		rights[key] = get_share()
+	}
+}
+
+// ask peers for rights until this node holds at least delta rights of key
+func acquire_rights(key string, delta int) {
+	for _, vertex := range node.NodeIDs() {
+		if vertex == node.ID() {
+			continue
+		}
+		rw.RLock()
+		need := delta - rights[key]
+		rw.RUnlock()
+		if need <= 0 {
+			return
+		}
+
+		body := make(map[string]any)
+		body["type"] = "transfer"
+		body["key"] = key
+		body["amount"] = need
+
 		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
-		defer cancel()
-		kv.CompareAndSwap(ctx, "counter", from, to, true)
-	}(counter, counter+delta)
-	counter += delta
+		resp, err := node.SyncRPC(ctx, vertex, body)
+		cancel()
+		if err != nil {
+			// peer unreachable, try the next one
+			continue
+		}
+		resp_body, err := get_body_from_msg(resp)
+		if err != nil {
+			continue
+		}
+
+		// received rights need not be durable, losing them only loses headroom
+		persist_mu.Lock()
+		rw.Lock()
+		rights[key] += int(resp_body["granted"].(float64))
+		rw.Unlock()
+		persist_mu.Unlock()
+	}
+}
+
+func get_counter(key string) int {
+	rw.RLock()
+	defer rw.RUnlock()
+	value := 0
+	for _, count := range counters[key] {
+		value += count
+	}
+	return value
 }
 
 /*
@@ -69,17 +376,29 @@ func add_delta(delta int) {
 ------------------
 */
 
-func handle_propagate(msg maelstrom.Message) error {
+func handle_gossip(msg maelstrom.Message) error {
 	body, err := get_body_from_msg(msg)
 	if err != nil {
 		return err
 	}
-	delta := int(body["delta"].(float64))
-	add_delta(delta)
+	delta := get_state_from_body(body["delta"])
+	if !is_ready() {
+		// not acked, the sender ships it again after recovery
+		return err_recovering
+	}
+
+	// acked entries must be durable, the sender won't ship them again
+	err = commit(func(next_counters state, next_rights map[string]int) error {
+		next_counters.join(delta)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
 	reply := make(map[string]any)
-	reply["type"] = "propagate_ok"
-	return node.Reply(msg, body)
+	reply["type"] = "gossip_ok"
+	return node.Reply(msg, reply)
 }
 
 func handle_add(msg maelstrom.Message) error {
@@ -88,11 +407,40 @@ func handle_add(msg maelstrom.Message) error {
 		return err
 	}
 
+	key := get_key(body)
 	delta := int(body["delta"].(float64))
-	add_delta(delta)
 
-	// Propagate this msg to all nodes in the network
-	propagate(body)
+	// peers join counts with max, a decrease would never reach them
+	if delta < 0 {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, "delta must not be negative")
+	}
+	if !is_ready() {
+		return err_recovering
+	}
+
+	// spends delta rights of key in bounded mode, fails if this node doesn't hold enough
+	err_no_rights := maelstrom.NewRPCError(maelstrom.PreconditionFailed, "add would exceed the bound of "+key)
+	update := func(next_counters state, next_rights map[string]int) error {
+		if bound > 0 {
+			init_rights(next_rights, key)
+			if next_rights[key] < delta {
+				return err_no_rights
+			}
+			next_rights[key] -= delta
+		}
+		next_counters.add(key, node.ID(), delta)
+		return nil
+	}
+
+	// shipped to other nodes in the next gossip round
+	err = commit(update)
+	if err == err_no_rights {
+		acquire_rights(key, delta)
+		err = commit(update)
+	}
+	if err != nil {
+		return err
+	}
 
 	var reply map[string]any = make(map[string]any)
 	reply["type"] = "add_ok"
@@ -100,36 +448,117 @@ func handle_add(msg maelstrom.Message) error {
 }
 
 func handle_read(msg maelstrom.Message) error {
-	_, err := get_body_from_msg(msg)
+	body, err := get_body_from_msg(msg)
 	if err != nil {
 		return err
 	}
-
-	// Read into local variable in background and update state
-	go func() {
-		for {
-			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
-			defer cancel()
-			err = kv.ReadInto(ctx, "counter", counter)
-			if err == nil {
-				return
-			}
-		}
-	}()
+	key := get_key(body)
+	if !is_ready() {
+		return err_recovering
+	}
 
 	var reply map[string]any = make(map[string]any)
 	reply["type"] = "read_ok"
-	// return local variable assuming it always contains updated state
-	reply["value"] = counter
+	// return local state assuming it always contains updated state
+	reply["value"] = get_counter(key)
+	return node.Reply(msg, reply)
+}
+
+func handle_transfer(msg maelstrom.Message) error {
+	body, err := get_body_from_msg(msg)
+	if err != nil {
+		return err
+	}
+	key := get_key(body)
+	amount := int(body["amount"].(float64))
+	if !is_ready() {
+		return err_recovering
+	}
+
+	// rights are given up durably before the reply, a restart can't grant them twice
+	granted := 0
+	err = commit(func(next_counters state, next_rights map[string]int) error {
+		init_rights(next_rights, key)
+		granted = min(amount, next_rights[key])
+		next_rights[key] -= granted
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var reply map[string]any = make(map[string]any)
+	reply["type"] = "transfer_ok"
+	reply["granted"] = granted
+	return node.Reply(msg, reply)
+}
+
+func handle_read_state(msg maelstrom.Message) error {
+	if !is_ready() {
+		return err_recovering
+	}
+
+	rw.Lock()
+	snapshot := counters.copy()
+	// the requester may have lost entries this node has seen acked, ship everything again
+	delete(acked, msg.Src)
+	rw.Unlock()
+
+	var reply map[string]any = make(map[string]any)
+	reply["type"] = "read_state_ok"
+	reply["counters"] = snapshot
+	return node.Reply(msg, reply)
+}
+
+func handle_list_counters(msg maelstrom.Message) error {
+	if !is_ready() {
+		return err_recovering
+	}
+
+	rw.RLock()
+	keys := make([]string, 0, len(counters))
+	for key := range counters {
+		keys = append(keys, key)
+	}
+	rw.RUnlock()
+	sort.Strings(keys)
+
+	var reply map[string]any = make(map[string]any)
+	reply["type"] = "list_counters_ok"
+	reply["counters"] = keys
 	return node.Reply(msg, reply)
 }
 
 func main() {
 	node = maelstrom.NewNode()
 	kv = *maelstrom.NewSeqKV(node)
+	if value, ok := os.LookupEnv("COUNTER_BOUND"); ok {
+		var err error
+		bound, err = strconv.Atoi(value)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	node.Handle("init", func(msg maelstrom.Message) error {
+		go recover_state()
+		return nil
+	})
 	node.Handle("add", handle_add)
 	node.Handle("read", handle_read)
-	node.Handle("propagate", handle_propagate)
+	node.Handle("list_counters", handle_list_counters)
+	node.Handle("gossip", handle_gossip)
+	node.Handle("transfer", handle_transfer)
+	node.Handle("read_state", handle_read_state)
+
+	go func() {
+		for {
+			time.Sleep(gossip_interval)
+			if is_ready() {
+				gossip()
+			}
+		}
+	}()
+
 	err := node.Run()
 	if err != nil {
 		log.Fatal(err)
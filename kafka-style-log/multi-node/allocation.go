@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+/*
+----- Offset Allocation -----
+
+How a send gets its offset, set by OFFSET_ALLOCATION
+
+	owner - the owner of the key assigns it (default, see ownership.go)
+	cas   - any node reserves it in lin-kv, no forwarding
+
+With cas, the node handling the send reserves the next offset of the key with a
+compare-and-swap of latest_<key> in lin-kv from the latest offset it read to the next one.
+A missing key counts as offset 0. A lost race fails with precondition-failed, the node
+reads the new latest offset and tries again. Every offset is reserved by exactly one send.
+
+The message is then created in lin-kv as <key>_<offset> with a compare-and-swap that
+only succeeds if the key doesn't exist, and only after that is the send acked.
+A send that fails after its reservation leaves a gap in the offsets of its key.
+
+A poll of an offset that hasn't been gossiped here reads it from lin-kv. If lin-kv
+doesn't have it, the poll stops there. Once it is still missing allocation_timeout after
+the first miss, the poll creates <key>_<offset> as a gap marker with the same
+compare-and-swap. Only one of the two creates wins, so the offset is either the message
+or a gap for every node: a send that loses fails, a poll that loses reads the message.
+The wait only keeps polls from failing sends that are still in flight, a gap is never
+inferred from a miss. Polls skip a gap from then on.
+*/
+
+const allocation_owner string = "owner"
+const allocation_cas string = "cas"
+
+const allocation_timeout = 2 * time.Second
+
+// value of an offset given up as a gap, messages are numbers
+const gap_marker string = "gap"
+
+// compared against by a create, neither a message nor a gap ever equals it
+const unwritten string = "unwritten"
+
+var offset_allocation string = allocation_owner
+
+// guarded by rw. by message id, when a poll first missed it in lin-kv and the decided gaps
+var missing_since map[string]time.Time = make(map[string]time.Time)
+var gaps map[string]bool = make(map[string]bool)
+
+// KV Stores
+var linKV maelstrom.KV
+
+// reserves the next offset of key in lin-kv, retrying until it wins a compare-and-swap
+func reserve_offset(ctx context.Context, key string) (float64, error) {
+	latest_key := fmt.Sprintf("latest_%s", key)
+	for {
+		exists := true
+		current, err := linKV.ReadInt(ctx, latest_key)
+		if err != nil {
+			if rpc_err, ok := err.(*maelstrom.RPCError); !ok || rpc_err.Code != maelstrom.KeyDoesNotExist {
+				return 0, err
+			}
+			exists = false
+			current = 0
+		}
+
+		err = linKV.CompareAndSwap(ctx, latest_key, current, current+1, !exists)
+		if err == nil {
+			return float64(current + 1), nil
+		}
+		if rpc_err, ok := err.(*maelstrom.RPCError); !ok || rpc_err.Code != maelstrom.PreconditionFailed {
+			return 0, err
+		}
+	}
+}
+
+// creates id in lin-kv as value, fails with precondition-failed if it already exists
+func create_value(ctx context.Context, id string, value any) error {
+	return linKV.CompareAndSwap(ctx, id, unwritten, value, true)
+}
+
+func is_precondition_failed(err error) bool {
+	rpc_err, ok := err.(*maelstrom.RPCError)
+	return ok && rpc_err.Code == maelstrom.PreconditionFailed
+}
+
+// reserves an offset for the message and creates it in lin-kv, then stores it locally
+func append_message_with_cas(key string, msg_val float64) (float64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), allocation_timeout)
+	defer cancel()
+
+	offset, err := reserve_offset(ctx, key)
+	if err != nil {
+		return 0, maelstrom.NewRPCError(maelstrom.Crash, "could not reserve an offset: "+err.Error())
+	}
+	err = create_value(ctx, fmt.Sprintf("%s_%f", key, offset), msg_val)
+	if is_precondition_failed(err) {
+		return 0, maelstrom.NewRPCError(maelstrom.PreconditionFailed, fmt.Sprintf("offset %v was given up as a gap before the message was written", offset))
+	}
+	if err != nil {
+		return 0, maelstrom.NewRPCError(maelstrom.Crash, "could not write the message: "+err.Error())
+	}
+
+	rw.Lock()
+	defer rw.Unlock()
+	latest_offsets[key] = max(latest_offsets[key], offset)
+	return offset, put_message(key, offset, msg_val)
+}
+
+/*
+Reads the message at offset of key from lin-kv and stores it locally, decides that the
+offset is a gap once it has been missing for allocation_timeout.
+Returns the message and true, or false and whether the offset is a gap.
+*/
+func fetch_message(key string, offset float64) (float64, bool, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), allocation_timeout)
+	defer cancel()
+
+	id := fmt.Sprintf("%s_%f", key, offset)
+	var value any
+	err := linKV.ReadInto(ctx, id, &value)
+	if err != nil {
+		if rpc_err, ok := err.(*maelstrom.RPCError); !ok || rpc_err.Code != maelstrom.KeyDoesNotExist {
+			return 0, false, false
+		}
+		rw.Lock()
+		since, ok := missing_since[id]
+		if !ok {
+			missing_since[id] = time.Now()
+		}
+		rw.Unlock()
+		if !ok || time.Since(since) < allocation_timeout {
+			return 0, false, false
+		}
+
+		err = create_value(ctx, id, gap_marker)
+		if err == nil {
+			value = gap_marker
+		} else if is_precondition_failed(err) {
+			// the message was written first
+			err = linKV.ReadInto(ctx, id, &value)
+		}
+		if err != nil {
+			return 0, false, false
+		}
+	}
+
+	rw.Lock()
+	defer rw.Unlock()
+	delete(missing_since, id)
+	if value == gap_marker {
+		gaps[id] = true
+		return 0, false, true
+	}
+	msg_val, ok := value.(float64)
+	if !ok {
+		log.Printf("ERROR message %s is %v, not a number", id, value)
+		return 0, false, false
+	}
+	err = put_message(key, offset, msg_val)
+	if err != nil {
+		log.Printf("ERROR storing fetched message: %s", err)
+	}
+	return msg_val, true, false
+}
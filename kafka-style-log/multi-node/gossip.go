@@ -0,0 +1,121 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+/*
+----- Gossip -----
+
+Sends and commits are gossiped to every peer in batches. Every item is pending for a
+peer until the peer acks a batch holding it, every gossip_interval each peer is sent its
+pending items again, at most max_gossip_batch of each kind. A lost batch or an error
+reply is simply sent again in the next round, receivers store items idempotently:
+a known message is skipped and a commit never moves an offset back.
+
+A node that restarts loses its pending items, so recovery queues every message
+and committed offset it replays for every peer.
+*/
+
+const gossip_interval = 2 * time.Second
+const max_gossip_batch = 1000
+
+type gossip_queue struct {
+	kind    string // message type of a batch
+	pending map[string]map[int]map[string]any
+}
+
+// guarded by gossip_mu. pending[peer] holds the items that peer hasn't acked yet, by item id
+var gossip_mu sync.Mutex
+var next_gossip_id int = 0
+var send_gossip gossip_queue = gossip_queue{"gossip_send", make(map[string]map[int]map[string]any)}
+var commit_gossip gossip_queue = gossip_queue{"gossip_commit_offset", make(map[string]map[int]map[string]any)}
+
+func (q *gossip_queue) push(item map[string]any) {
+	gossip_mu.Lock()
+	defer gossip_mu.Unlock()
+	next_gossip_id++
+	for _, vertex := range node.NodeIDs() {
+		if vertex == node.ID() {
+			continue
+		}
+		if _, ok := q.pending[vertex]; !ok {
+			q.pending[vertex] = make(map[int]map[string]any)
+		}
+		q.pending[vertex][next_gossip_id] = item
+	}
+}
+
+// sends every peer its pending items, they stay pending until the peer acks
+func (q *gossip_queue) flush() {
+	gossip_mu.Lock()
+	batches := make(map[string]map[int]map[string]any)
+	for vertex, queue := range q.pending {
+		if len(queue) == 0 {
+			continue
+		}
+		batch := make(map[int]map[string]any)
+		for id, item := range queue {
+			if len(batch) >= max_gossip_batch {
+				break
+			}
+			batch[id] = item
+		}
+		batches[vertex] = batch
+	}
+	gossip_mu.Unlock()
+
+	for vertex, batch := range batches {
+		log.Printf("Gossiping %d %s items to %s", len(batch), q.kind, vertex)
+		items := make([]map[string]any, 0, len(batch))
+		for _, item := range batch {
+			items = append(items, item)
+		}
+		var body map[string]any = make(map[string]any)
+		body["type"] = q.kind
+		body["batch"] = items
+		node.RPC(vertex, body, func(msg maelstrom.Message) error {
+			// error replies land here too, only an ok means the peer stored the batch
+			if msg.RPCError() != nil || msg.Type() != q.kind+"_ok" {
+				return nil
+			}
+			gossip_mu.Lock()
+			defer gossip_mu.Unlock()
+			for id := range batch {
+				delete(q.pending[vertex], id)
+			}
+			return nil
+		})
+	}
+}
+
+// queues a stored message for every peer
+func gossip_message(key string, offset float64, msg_val float64) {
+	var item map[string]any = make(map[string]any)
+	item["key"] = key
+	item["msg"] = msg_val
+	item["latest_offset"] = offset + 1
+	send_gossip.push(item)
+}
+
+// queues committed offsets of group for every peer
+func gossip_commit(group string, offsets map[string]any) {
+	var item map[string]any = make(map[string]any)
+	item["group"] = group
+	item["offsets"] = offsets
+	commit_gossip.push(item)
+}
+
+func init_gossip_routine() {
+	go func() {
+		for {
+			time.Sleep(gossip_interval)
+			send_gossip.flush()
+			commit_gossip.flush()
+		}
+	}()
+}
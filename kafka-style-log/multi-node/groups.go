@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+/*
+----- Consumer Groups -----
+
+Every consumer group has its own committed offsets. commit_offsets and
+list_committed_offsets take an optional group, requests without one use default_group.
+
+Commits are gossiped with their group and never move a committed offset back.
+Retention keeps every message above the lowest offset any group committed for the key.
+Groups that never committed a key don't hold back its retention.
+*/
+
+const default_group string = "default"
+
+// guarded by rw. group -> key -> committed offset
+var committed_offsets map[string]map[string]float64 = make(map[string]map[string]float64)
+
+func get_group_from_body(body map[string]any) string {
+	if group, ok := body["group"].(string); ok {
+		return group
+	}
+	return default_group
+}
+
+func get_group_offsets(group string) map[string]float64 {
+	offsets, ok := committed_offsets[group]
+	if !ok {
+		offsets = make(map[string]float64)
+		committed_offsets[group] = offsets
+	}
+	return offsets
+}
+
+// moves the committed offset of key in group forward, must be called with rw held
+func commit_offset(group string, key string, offset float64) {
+	offsets := get_group_offsets(group)
+	// commits never move back, gossip can deliver them out of order
+	if current, ok := offsets[key]; ok && current >= offset {
+		return
+	}
+	offsets[key] = offset
+}
+
+// lowest offset committed for key by any group, false if none committed it. must be called with rw held
+func get_lowest_committed(key string) (float64, bool) {
+	var lowest float64
+	found := false
+	for _, offsets := range committed_offsets {
+		if offset, ok := offsets[key]; ok && (!found || offset < lowest) {
+			lowest = offset
+			found = true
+		}
+	}
+	return lowest, found
+}
+
+// reads committed.json, files from before groups hold the offsets of the default group
+func decode_committed_offsets(buf []byte) error {
+	err := json.Unmarshal(buf, &committed_offsets)
+	if err == nil {
+		return nil
+	}
+	var offsets map[string]float64
+	err = json.Unmarshal(buf, &offsets)
+	if err != nil {
+		return err
+	}
+	committed_offsets = map[string]map[string]float64{default_group: offsets}
+	return nil
+}
+
+/*
+------------------
+   RPC Handlers
+------------------
+*/
+
+func handle_list_groups(msg maelstrom.Message) error {
+	rw.RLock()
+	groups := make([]string, 0, len(committed_offsets))
+	for group := range committed_offsets {
+		groups = append(groups, group)
+	}
+	rw.RUnlock()
+	sort.Strings(groups)
+
+	var reply map[string]any = make(map[string]any)
+	reply["type"] = "list_groups_ok"
+	reply["groups"] = groups
+	return node.Reply(msg, reply)
+}
+
+/*
+Messages of every key the group hasn't committed yet, by key. A key without a commit
+lags by all of its retained messages. keys is optional, without it every key with messages is reported.
+*/
+func handle_group_lag(msg maelstrom.Message) error {
+	body := get_body_from_msg(msg)
+	group := get_group_from_body(body)
+
+	var lag map[string]float64 = make(map[string]float64)
+	rw.RLock()
+	keys := make([]string, 0)
+	if list, ok := body["keys"].([]any); ok {
+		for _, key := range list {
+			keys = append(keys, key.(string))
+		}
+	} else {
+		for key := range retained {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		r, ok := retained[key]
+		if !ok {
+			continue
+		}
+		latest := latest_offsets[key]
+		committed, ok := committed_offsets[group][key]
+		if !ok {
+			committed = r.earliest - 1
+		}
+		lag[key] = max(latest-committed, 0)
+	}
+	rw.RUnlock()
+
+	var reply map[string]any = make(map[string]any)
+	reply["type"] = "group_lag_ok"
+	reply["group"] = group
+	reply["lag"] = lag
+	return node.Reply(msg, reply)
+}
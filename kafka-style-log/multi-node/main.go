@@ -1,12 +1,11 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"os"
 	"sync"
-	"time"
 
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
 )
@@ -15,37 +14,38 @@ import (
 
 Strategy:
 
-SeqKV doesn't work in real-time constraints but LinKV does.
-
-Use SeqKV to store messages for each offset of a client. - background process
-Use LinKV to store latest offsets for each client. - background process
+Every node keeps all messages and offsets in memory and on local disk (see storage.go),
+gossip spreads sends and commits to the other nodes. The owner of a key assigns its
+offsets (see ownership.go), or they are reserved in lin-kv (see allocation.go).
 
 --- Update:
 This strategy works well upto a max rate of 400 reqs/second.
 Beyond that, timeouts will become frequent as a result of many heavy coroutines that need to be scheduled.
-To fix this bottleneck, I added batching. Gossip & write in batches.
+To fix this bottleneck, I added batching. Gossip in batches.
 This scaled upto 2k rps with a gossip containing ~40 msgs at the least.
 
 Send Handler:
 
-- Ack the send req.
+- Forward the send to the owner of the key if it isn't this node, relay its reply
+  ( with cas allocation: reserve the offset and create the message in lin-kv instead )
 - Update in-memory cache of messages and latest offsets
-- Write to SeqKV the message with corresponding offset
-- Write to LinKV the latest offset
-- Gossip the send message to other nodes in the network
-- Gossip Latest offset to other nodes in the network
+- Append the message to the key's segment on disk
+- Ack the send req.
+- Gossip the message with its offset to other nodes in the network, until each acks it (see gossip.go)
 
 Poll Handler:
 
 - Assumption is that all in-memory caches are fresh
 	( stale state here is invalidated when new gossips are read )
-- Read all messages from in-memory state and respond
+- Read messages from in-memory state, at most max_messages and max_bytes per key, and respond
+- Stop at the first offset of a key that hasn't arrived yet, a poll returns a contiguous run
+  ( with cas allocation: read it from lin-kv first, and skip offsets decided to be gaps )
 
 Commit Offset handler:
 
-- Update local committed offset state
-- Write to LinKV
-- Gossip to other nodes in network
+- Update local committed offset state of the consumer group
+- Write the committed offsets to disk
+- Gossip to other nodes in network with the group, until each acks it
 
 List Committed Offsets Handler:
 
@@ -56,11 +56,9 @@ List Committed Offsets Handler:
 Note:
 -----
 
-In this strategy, KV Stores are only used as persistent storage,
-to reload in-memory cache in the event of a node crash.
-
-However, this crash is not simulated as a nemesis in this challenge,
-which means it is possible to pass this challenge without using KV at all.
+On restart a node replays its segments from disk into the in-memory cache,
+messages and commits it missed while it was down are still pending at its peers
+and arrive with their next gossip.
 
 */
 
@@ -68,12 +66,7 @@ which means it is possible to pass this challenge without using KV at all.
 var node *maelstrom.Node
 var rw sync.RWMutex
 
-// KV Stores
-var seqKV maelstrom.KV
-var linKV maelstrom.KV
-
-// in memory cache
-var committed_offsets map[string]float64 = make(map[string]float64)
+// in memory cache, see retention.go for how messages are dropped and groups.go for committed offsets
 var latest_offsets map[string]float64 = make(map[string]float64)
 var messages map[string]float64 = make(map[string]float64)
 
@@ -93,33 +86,47 @@ func get_body_from_msg(msg maelstrom.Message) map[string]any {
 	return body
 }
 
-func get_offset(key string) float64 {
-	rw.RLock()
-	defer rw.RUnlock()
-	value, ok := latest_offsets[key]
-	if !ok {
-		latest_offsets[key] = 1
+// stores a message at the next offset of key, offsets of a key are strictly increasing
+func append_message(key string, msg_val float64) (float64, error) {
+	rw.Lock()
+	defer rw.Unlock()
+	offset := latest_offsets[key] + 1
+	err := put_message(key, offset, msg_val)
+	if err != nil {
+		// the offset goes to the next send, a poll must not wait on it
+		return 0, err
 	}
-
-	return value + 1
+	latest_offsets[key] = offset
+	return offset, nil
 }
 
-func set_offset(key string, value float64) {
-	rw.Lock()
-	defer rw.Unlock()
-	latest_offsets[key] = value
+/*
+Message at offset of key for a poll, fetched from lin-kv with cas allocation if it hasn't
+arrived here yet. Returns the message and true, or false and whether the offset is a gap.
+*/
+func get_message(key string, offset float64) (float64, bool, bool) {
+	id := fmt.Sprintf("%s_%f", key, offset)
+	rw.RLock()
+	msg_val, ok := messages[id]
+	gap := gaps[id]
+	rw.RUnlock()
+	if ok || gap || offset_allocation != allocation_cas {
+		return msg_val, ok, gap
+	}
+	return fetch_message(key, offset)
 }
 
-func set_val(m map[string]float64, key string, val float64) {
-	rw.Lock()
-	defer rw.Unlock()
-	m[key] = val
+// max_messages and max_bytes of a poll, both optional and per key. 0 means no limit
+func get_budget_from_body(body map[string]any) (int, int) {
+	max_messages, _ := body["max_messages"].(float64)
+	max_bytes, _ := body["max_bytes"].(float64)
+	return int(max_messages), int(max_bytes)
 }
 
-func get_val(m map[string]float64, key string) float64 {
-	rw.RLock()
-	defer rw.RUnlock()
-	return m[key]
+// size of a message in bytes, as json
+func get_size(msg_val float64) int {
+	buf, _ := json.Marshal(msg_val)
+	return len(buf)
 }
 
 /*
@@ -128,27 +135,31 @@ func get_val(m map[string]float64, key string) float64 {
 ------------------
 */
 
-var send_batch []map[string]any = make([]map[string]any, 0)
-
 func handle_send(msg maelstrom.Message) error {
 	body := get_body_from_msg(msg)
 	var key string = body["key"].(string)
 	msg_val := body["msg"].(float64)
 
-	offset := get_offset(key)
-	msg_storage_key := fmt.Sprintf("%s_%f", key, offset)
-	set_val(messages, msg_storage_key, msg_val)
+	var offset float64
+	var err error
+	if offset_allocation == allocation_cas {
+		offset, err = append_message_with_cas(key, msg_val)
+	} else if owner := get_owner(key); owner != node.ID() {
+		return forward_send(msg, owner, body)
+	} else {
+		offset, err = append_message(key, msg_val)
+	}
+	if err != nil {
+		return err
+	}
 
 	reply := make(map[string]any)
 	reply["type"] = "send_ok"
 	reply["offset"] = offset
 
-	set_offset(key, offset)
 	node.Reply(msg, reply)
 
-	body["latest_offset"] = offset + 1
-
-	send_batch = append(send_batch, body)
+	gossip_message(key, offset, msg_val)
 	return nil
 }
 
@@ -157,16 +168,41 @@ func handle_poll(msg maelstrom.Message) error {
 
 	var offsets map[string]any = body["offsets"].(map[string]any)
 	var results map[string][][]float64 = make(map[string][][]float64)
+	max_messages, max_bytes := get_budget_from_body(body)
 
 	for key, offset := range offsets {
-		latest_offset := get_offset(key) - 1
+		rw.RLock()
+		latest_offset := latest_offsets[key]
 		req_offset := offset.(float64)
+		if r, ok := retained[key]; ok {
+			req_offset = max(req_offset, r.earliest)
+		}
+		rw.RUnlock()
 
 		result := make([][]float64, 0)
+		bytes := 0
 		for ; req_offset <= latest_offset; req_offset++ {
-			results[key] = append(results[key], []float64{req_offset, get_val(messages, fmt.Sprintf("%s_%f", key, req_offset))})
+			if max_messages > 0 && len(result) >= max_messages {
+				break
+			}
+			msg_val, ok, gap := get_message(key, req_offset)
+			if gap {
+				continue
+			}
+			if !ok {
+				// not here yet, skipping it would let the consumer commit past it
+				break
+			}
+			// the first message is returned even if it is over max_bytes, so a consumer never gets stuck
+			bytes += get_size(msg_val)
+			if max_bytes > 0 && bytes > max_bytes && len(result) > 0 {
+				break
+			}
+			result = append(result, []float64{req_offset, msg_val})
+		}
+		if len(result) > 0 {
+			results[key] = result
 		}
-		results[key] = result
 	}
 
 	var reply map[string]any = make(map[string]any)
@@ -176,15 +212,19 @@ func handle_poll(msg maelstrom.Message) error {
 	return node.Reply(msg, reply)
 }
 
-var commit_batch []map[string]any = make([]map[string]any, 0)
-
 func handle_commit_offsets(msg maelstrom.Message) error {
 	body := get_body_from_msg(msg)
 	var offsets map[string]any = body["offsets"].(map[string]any)
+	group := get_group_from_body(body)
 
+	rw.Lock()
 	for key, offset := range offsets {
-		commit_offset := offset.(float64)
-		set_val(committed_offsets, key, commit_offset)
+		commit_offset(group, key, offset.(float64))
+	}
+	err := save_committed_offsets()
+	rw.Unlock()
+	if err != nil {
+		return err
 	}
 
 	var reply map[string]string = make(map[string]string)
@@ -192,17 +232,23 @@ func handle_commit_offsets(msg maelstrom.Message) error {
 
 	node.Reply(msg, reply)
 
-	body["type"] = "gossip_commit_offset"
-	commit_batch = append(commit_batch, body)
-
+	gossip_commit(group, offsets)
 	return nil
 }
 
 func handle_list_committed_offsets(msg maelstrom.Message) error {
+	body := get_body_from_msg(msg)
 	var reply map[string]any = make(map[string]any)
 	reply["type"] = "list_committed_offsets_ok"
-	reply["offsets"] = committed_offsets
-	return node.Reply(msg, reply)
+	rw.RLock()
+	offsets, ok := committed_offsets[get_group_from_body(body)]
+	if !ok {
+		offsets = make(map[string]float64)
+	}
+	reply["offsets"] = offsets
+	err := node.Reply(msg, reply)
+	rw.RUnlock()
+	return err
 }
 
 /*
@@ -218,11 +264,21 @@ func handle_send_gossip(msg maelstrom.Message) error {
 		body := v.(map[string]any)
 		var key string = body["key"].(string)
 		msg_val := body["msg"].(float64)
-		offset := body["latest_offset"]
-		msg_storage_key := fmt.Sprintf("%s_%f", key, offset)
-		set_val(messages, msg_storage_key, msg_val)
+		offset := body["latest_offset"].(float64) - 1
+		rw.Lock()
+		err := put_message(key, offset, msg_val)
+		if err != nil {
+			rw.Unlock()
+			// not acked, the sender ships the batch again
+			return err
+		}
+		latest_offsets[key] = max(latest_offsets[key], offset)
+		rw.Unlock()
 	}
-	return nil
+
+	var reply map[string]any = make(map[string]any)
+	reply["type"] = "gossip_send_ok"
+	return node.Reply(msg, reply)
 }
 
 func handle_commit_offset_gossip(msg maelstrom.Message) error {
@@ -233,104 +289,62 @@ func handle_commit_offset_gossip(msg maelstrom.Message) error {
 		body := v.(map[string]any)
 		var offsets map[string]any = body["offsets"].(map[string]any)
 
+		group := get_group_from_body(body)
+		rw.Lock()
 		for key, offset := range offsets {
-			commit_offset := offset.(float64)
-			set_val(committed_offsets, key, commit_offset)
+			commit_offset(group, key, offset.(float64))
 		}
-	}
-
-	return nil
-}
-
-/*
----------------------
-
-	Background
-
----------------------
-*/
-func init_batch_routines() {
-	go func() {
-		for {
-			if len(send_batch) >= 2 {
-				log.Printf("Gossiping %d SEND messages", len(send_batch))
-				ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-
-				// Gossip Send Message, latest offset to other nodes
-				var body map[string]any = make(map[string]any)
-				body["type"] = "gossip_send"
-				body["batch"] = send_batch
-				for _, vertex := range node.NodeIDs() {
-					if vertex == node.ID() {
-						continue
-					}
-					node.RPC(vertex, body, nil)
-				}
-				for _, body := range send_batch {
-					var key string = body["key"].(string)
-					msg_val := body["msg"].(float64)
-					offset := body["latest_offset"].(float64) - 1
-
-					// Write latest Offset to LinKV
-					recent_offset_key := fmt.Sprintf("latest_%s", key)
-					linKV.CompareAndSwap(ctx, recent_offset_key, offset, offset, true)
-
-					// Write Message to SeqKV
-					seqKvKey := fmt.Sprintf("%s_%f", key, offset)
-					seqKV.Write(ctx, seqKvKey, msg_val)
-				}
-				cancel()
-				send_batch = make([]map[string]any, 0)
-			}
-
-			if len(commit_batch) >= 2 {
-				log.Printf("Gossiping %d COMMIT messages", len(commit_batch))
-				ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-				// Gossip Latest Offset to other nodes
-				var body map[string]any = make(map[string]any)
-				body["type"] = "gossip_commit_offset"
-				body["batch"] = commit_batch
-				for _, vertex := range node.NodeIDs() {
-					if vertex == node.ID() {
-						continue
-					}
-					node.RPC(vertex, body, nil)
-				}
-
-				for _, body := range commit_batch {
-					// Update offsets in LinKV
-					var offsets map[string]any = body["offsets"].(map[string]any)
-					for key, offset := range offsets {
-						commit_offset := offset.(float64)
-						committed_offsets[key] = commit_offset
-						commit_offset_key := fmt.Sprintf("commit_%s", key)
-						linKV.CompareAndSwap(ctx, commit_offset_key, latest_offsets[key], commit_offset, true)
-					}
-				}
-				cancel()
-				commit_batch = make([]map[string]any, 0)
-			}
-
-			time.Sleep(2 * time.Second)
+		err := save_committed_offsets()
+		rw.Unlock()
+		if err != nil {
+			// not acked, the sender ships the batch again
+			return err
 		}
-	}()
+	}
 
+	var reply map[string]any = make(map[string]any)
+	reply["type"] = "gossip_commit_offset_ok"
+	return node.Reply(msg, reply)
 }
 
 func main() {
 	node = maelstrom.NewNode()
-	seqKV = *maelstrom.NewSeqKV(node)
+	init_default_retention()
 	linKV = *maelstrom.NewLinKV(node)
+	if value, ok := os.LookupEnv("OFFSET_ALLOCATION"); ok {
+		if value != allocation_owner && value != allocation_cas {
+			log.Fatalf("unknown offset allocation %s", value)
+		}
+		offset_allocation = value
+	}
+	data_dir = os.Getenv("KAFKA_DATA_DIR")
+	if value, ok := os.LookupEnv("KAFKA_FSYNC"); ok {
+		if value != fsync_always && value != fsync_none {
+			log.Fatalf("unknown fsync policy %s", value)
+		}
+		fsync_policy = value
+	}
 
+	node.Handle("init", func(msg maelstrom.Message) error {
+		if data_dir == "" {
+			return nil
+		}
+		return recover_messages()
+	})
 	node.Handle("send", handle_send)
 	node.Handle("poll", handle_poll)
 	node.Handle("commit_offsets", handle_commit_offsets)
 	node.Handle("list_committed_offsets", handle_list_committed_offsets)
+	node.Handle("list_groups", handle_list_groups)
+	node.Handle("group_lag", handle_group_lag)
+	node.Handle("set_retention", handle_set_retention)
+	node.Handle("list_offsets", handle_list_offsets)
 
 	node.Handle("gossip_send", handle_send_gossip)
 	node.Handle("gossip_commit_offset", handle_commit_offset_gossip)
 
-	init_batch_routines()
+	init_gossip_routine()
+	init_retention_routine()
 
 	err := node.Run()
 	if err != nil {
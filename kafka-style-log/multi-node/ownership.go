@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+/*
+----- Key Ownership -----
+
+Every key is owned by one node, which assigns all offsets of the key, so offsets of a key
+are unique and increasing without a round trip to lin-kv. Other nodes forward a send to
+the owner and relay its reply. Polls and commits are still served by any node.
+
+Owners are picked by consistent hashing: every node is placed on a ring at
+virtual_nodes points, and a key belongs to the first node at or after the hash of the key.
+Every node builds the same ring from node.NodeIDs().
+
+While the owner of a key is unreachable, sends of that key fail.
+*/
+
+const virtual_nodes = 16
+const forward_timeout = 1 * time.Second
+
+type ring_point struct {
+	hash uint32
+	node string
+}
+
+var ring_once sync.Once
+var ring []ring_point
+
+func get_hash(value string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	return h.Sum32()
+}
+
+func build_ring() {
+	for _, id := range node.NodeIDs() {
+		for i := 0; i < virtual_nodes; i++ {
+			ring = append(ring, ring_point{get_hash(fmt.Sprintf("%s#%d", id, i)), id})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		if ring[i].hash != ring[j].hash {
+			return ring[i].hash < ring[j].hash
+		}
+		return ring[i].node < ring[j].node
+	})
+}
+
+func get_owner(key string) string {
+	ring_once.Do(build_ring)
+	hash := get_hash(key)
+	i := sort.Search(len(ring), func(i int) bool {
+		return ring[i].hash >= hash
+	})
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].node
+}
+
+// sends a client send on to the owner of its key and relays the reply
+func forward_send(msg maelstrom.Message, owner string, body map[string]any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), forward_timeout)
+	defer cancel()
+	delete(body, "msg_id")
+	resp, err := node.SyncRPC(ctx, owner, body)
+	if err != nil {
+		if _, ok := err.(*maelstrom.RPCError); ok {
+			return err
+		}
+		// the owner may still have stored it
+		return maelstrom.NewRPCError(maelstrom.Crash, "owner of the key did not reply in time")
+	}
+	reply := get_body_from_msg(resp)
+	delete(reply, "in_reply_to")
+	delete(reply, "msg_id")
+	return node.Reply(msg, reply)
+}
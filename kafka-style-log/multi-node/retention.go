@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+/*
+----- Retention -----
+
+Every key has a retention policy, the default one comes from the environment
+
+	KAFKA_RETENTION_MESSAGES  keep at most this many messages of a key
+	KAFKA_RETENTION_MS        keep messages for at most this many ms
+	KAFKA_RETENTION_BYTES     keep at most this many bytes of messages of a key
+
+A limit of 0 or an unset variable means no limit, by default the log grows forever.
+set_retention replaces the policy of a key, or the default without a key. It only
+changes the policy of the node it is sent to.
+
+Every retention_interval each node drops the oldest messages of every key from its
+in-memory cache until the key is within its limits. A message above the lowest committed
+offset of its key is never dropped, or any message if no group committed the key,
+unless the policy has force set.
+*/
+
+const retention_interval = 1 * time.Second
+
+type retention_policy struct {
+	max_messages int
+	max_age_ms   int64
+	max_bytes    int
+	force        bool // drop messages that aren't committed yet
+}
+
+// messages of a key held in memory, offsets below earliest were dropped
+type retained_log struct {
+	earliest float64
+	count    int
+	bytes    int
+}
+
+// guarded by rw
+var default_retention retention_policy
+var retention map[string]retention_policy = make(map[string]retention_policy)
+var retained map[string]*retained_log = make(map[string]*retained_log)
+var message_times map[string]int64 = make(map[string]int64)
+
+func get_env_limit(name string) int64 {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return 0
+	}
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || limit < 0 {
+		log.Fatalf("%s must be a number >= 0", name)
+	}
+	return limit
+}
+
+func init_default_retention() {
+	default_retention.max_messages = int(get_env_limit("KAFKA_RETENTION_MESSAGES"))
+	default_retention.max_age_ms = get_env_limit("KAFKA_RETENTION_MS")
+	default_retention.max_bytes = int(get_env_limit("KAFKA_RETENTION_BYTES"))
+}
+
+func get_policy(key string) retention_policy {
+	if policy, ok := retention[key]; ok {
+		return policy
+	}
+	return default_retention
+}
+
+func get_retained(key string) *retained_log {
+	r, ok := retained[key]
+	if !ok {
+		// offsets start at 1
+		r = &retained_log{1, 0, 0}
+		retained[key] = r
+	}
+	return r
+}
+
+// stores a message on disk and then in the cache, must be called with rw held. messages below earliest are dropped
+func put_message(key string, offset float64, msg_val float64) error {
+	at := time.Now().UnixMilli()
+	if !is_new_message(key, offset) {
+		return nil
+	}
+	// a message that failed to store must not be polled
+	err := write_message(key, offset, msg_val, at)
+	if err != nil {
+		return err
+	}
+	cache_message(key, offset, msg_val, at)
+	return nil
+}
+
+// false if the message is cached already or below earliest
+func is_new_message(key string, offset float64) bool {
+	_, ok := messages[fmt.Sprintf("%s_%f", key, offset)]
+	return !ok && offset >= get_retained(key).earliest
+}
+
+// stores a message in the cache, returns false if it was there already or is below earliest
+func cache_message(key string, offset float64, msg_val float64, at int64) bool {
+	if !is_new_message(key, offset) {
+		return false
+	}
+	r := get_retained(key)
+	id := fmt.Sprintf("%s_%f", key, offset)
+	messages[id] = msg_val
+	message_times[id] = at
+	r.count++
+	r.bytes += get_size(msg_val)
+	return true
+}
+
+// drops the oldest messages of key that are over its limits, must be called with rw held
+func apply_retention(key string, now int64) error {
+	policy := get_policy(key)
+	r := get_retained(key)
+	cutoff := r.earliest
+
+	count, bytes := r.count, r.bytes
+	for offset := r.earliest; offset <= latest_offsets[key]; offset++ {
+		id := fmt.Sprintf("%s_%f", key, offset)
+		msg_val, ok := messages[id]
+		if !ok {
+			// not gossiped here yet
+			continue
+		}
+		too_many := policy.max_messages > 0 && count > policy.max_messages
+		too_old := policy.max_age_ms > 0 && now-message_times[id] > policy.max_age_ms
+		too_big := policy.max_bytes > 0 && bytes > policy.max_bytes
+		if !too_many && !too_old && !too_big {
+			break
+		}
+		count--
+		bytes -= get_size(msg_val)
+		cutoff = offset + 1
+	}
+
+	if !policy.force {
+		committed, ok := get_lowest_committed(key)
+		if !ok {
+			return nil
+		}
+		cutoff = min(cutoff, committed+1)
+	}
+	for offset := r.earliest; offset < cutoff; offset++ {
+		id := fmt.Sprintf("%s_%f", key, offset)
+		if msg_val, ok := messages[id]; ok {
+			r.count--
+			r.bytes -= get_size(msg_val)
+			delete(messages, id)
+			delete(message_times, id)
+		}
+		delete(gaps, id)
+		delete(missing_since, id)
+	}
+	r.earliest = max(r.earliest, cutoff)
+	return drop_segments(key, r.earliest)
+}
+
+func init_retention_routine() {
+	go func() {
+		for {
+			time.Sleep(retention_interval)
+			now := time.Now().UnixMilli()
+			rw.Lock()
+			for key := range retained {
+				err := apply_retention(key, now)
+				if err != nil {
+					log.Printf("ERROR applying retention to %s: %s", key, err)
+				}
+			}
+			rw.Unlock()
+		}
+	}()
+}
+
+/*
+------------------
+   RPC Handlers
+------------------
+*/
+
+func handle_set_retention(msg maelstrom.Message) error {
+	body := get_body_from_msg(msg)
+
+	var policy retention_policy
+	if value, ok := body["max_messages"].(float64); ok {
+		policy.max_messages = int(value)
+	}
+	if value, ok := body["max_age_ms"].(float64); ok {
+		policy.max_age_ms = int64(value)
+	}
+	if value, ok := body["max_bytes"].(float64); ok {
+		policy.max_bytes = int(value)
+	}
+	policy.force, _ = body["force"].(bool)
+
+	rw.Lock()
+	var err error
+	if key, ok := body["key"].(string); ok {
+		retention[key] = policy
+		err = apply_retention(key, time.Now().UnixMilli())
+	} else {
+		default_retention = policy
+	}
+	rw.Unlock()
+	if err != nil {
+		return err
+	}
+
+	var reply map[string]any = make(map[string]any)
+	reply["type"] = "set_retention_ok"
+	return node.Reply(msg, reply)
+}
+
+// earliest and latest offset still held of every key, latest is below earliest if all were dropped
+func handle_list_offsets(msg maelstrom.Message) error {
+	body := get_body_from_msg(msg)
+
+	var results map[string]any = make(map[string]any)
+	rw.RLock()
+	keys := make([]string, 0)
+	if list, ok := body["keys"].([]any); ok {
+		for _, key := range list {
+			keys = append(keys, key.(string))
+		}
+	} else {
+		for key := range retained {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		r, ok := retained[key]
+		if !ok {
+			continue
+		}
+		var offsets map[string]float64 = make(map[string]float64)
+		offsets["earliest"] = r.earliest
+		offsets["latest"] = latest_offsets[key]
+		results[key] = offsets
+	}
+	rw.RUnlock()
+
+	var reply map[string]any = make(map[string]any)
+	reply["type"] = "list_offsets_ok"
+	reply["offsets"] = results
+	return node.Reply(msg, reply)
+}
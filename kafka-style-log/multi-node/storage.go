@@ -0,0 +1,466 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+----- Durability -----
+
+Enabled by setting KAFKA_DATA_DIR, every node keeps the messages it stores, its own and
+gossiped ones, in KAFKA_DATA_DIR/<node id>/<hex encoded key>/ as rolling segment files
+
+	<seq>.log    records [length uint32][crc32 uint32][json [offset, value, at]]
+	<seq>.index  sparse index, an entry [min offset float64][max offset float64][position int64]
+	             for every block of index_interval bytes of the log
+
+seq numbers the segments of a key in the order they were written, zero padded, and a
+segment is sealed after segment_size records. Gossip delivers messages out of offset
+order, so records are in arrival order and an index entry gives the range of offsets
+in the block starting at position, rather than the first offset like the single-node index.
+The entry of a block is written once the block is full or the segment is sealed.
+
+Reads are served by the in-memory cache and recovery replays every segment into it.
+It trusts the sealed segments and their index, which gives the offsets a segment holds
+for retention, and scans the last segment, truncating a partially written record at its
+end and rebuilding its index. committed.json holds the committed offsets of every group.
+
+Fsync policy, set by KAFKA_FSYNC
+
+	always - fsync the segment before a send is acked (default)
+	none   - leave flushing to the OS
+
+A segment is removed once retention has dropped every message in it.
+*/
+
+const fsync_always string = "always"
+const fsync_none string = "none"
+
+const segment_size = 1024
+const record_header_size = 8
+const index_entry_size = 24
+const index_interval = 4096
+
+var data_dir string = ""
+var fsync_policy string = fsync_always
+
+type index_entry struct {
+	min_offset float64
+	max_offset float64
+	position   int64 // start of the block in the log
+}
+
+type segment_file struct {
+	path       string // without extension
+	seq        int64
+	log        *os.File // nil once sealed
+	idx        *os.File // nil once sealed
+	size       int64
+	count      int
+	max_offset float64
+	index_size int64
+	block      index_entry // records after the last index entry
+	has_block  bool
+}
+
+// guarded by rw. key -> segments of the key, the last one is written to
+var segment_files map[string][]*segment_file = make(map[string][]*segment_file)
+
+func get_node_dir() string {
+	return filepath.Join(data_dir, node.ID())
+}
+
+func get_key_dir(key string) string {
+	return filepath.Join(get_node_dir(), hex.EncodeToString([]byte(key)))
+}
+
+func get_segment_path(dir string, seq int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d", seq))
+}
+
+func encode_record(offset float64, msg_val float64, at int64) ([]byte, error) {
+	payload, err := json.Marshal([]any{offset, msg_val, at})
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, record_header_size, record_header_size+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	return append(frame, payload...), nil
+}
+
+/*
+Decodes the records at the start of data as [offset, value, at].
+Returns the records, the position of every record and the length of the valid prefix,
+everything after it is a torn write.
+*/
+func decode_records(data []byte) ([][]float64, []int64, int64) {
+	records := make([][]float64, 0)
+	positions := make([]int64, 0)
+	var position int64 = 0
+	for int64(len(data))-position >= record_header_size {
+		header := data[position : position+record_header_size]
+		length := int64(binary.BigEndian.Uint32(header[0:4]))
+		checksum := binary.BigEndian.Uint32(header[4:8])
+		if int64(len(data))-position-record_header_size < length {
+			break
+		}
+		payload := data[position+record_header_size : position+record_header_size+length]
+		if crc32.ChecksumIEEE(payload) != checksum {
+			break
+		}
+		var item []float64
+		if json.Unmarshal(payload, &item) != nil || len(item) != 3 {
+			break
+		}
+		records = append(records, item)
+		positions = append(positions, position)
+		position += record_header_size + length
+	}
+	return records, positions, position
+}
+
+func encode_index_entry(entry index_entry) []byte {
+	buf := make([]byte, index_entry_size)
+	binary.BigEndian.PutUint64(buf[0:8], math.Float64bits(entry.min_offset))
+	binary.BigEndian.PutUint64(buf[8:16], math.Float64bits(entry.max_offset))
+	binary.BigEndian.PutUint64(buf[16:24], uint64(entry.position))
+	return buf
+}
+
+func decode_index(data []byte) []index_entry {
+	index := make([]index_entry, 0, len(data)/index_entry_size)
+	for i := 0; i+index_entry_size <= len(data); i += index_entry_size {
+		min_offset := math.Float64frombits(binary.BigEndian.Uint64(data[i : i+8]))
+		max_offset := math.Float64frombits(binary.BigEndian.Uint64(data[i+8 : i+16]))
+		position := int64(binary.BigEndian.Uint64(data[i+16 : i+24]))
+		index = append(index, index_entry{min_offset, max_offset, position})
+	}
+	return index
+}
+
+func create_segment(key string, seq int64) (*segment_file, error) {
+	dir := get_key_dir(key)
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	f := &segment_file{path: get_segment_path(dir, seq), seq: seq}
+	err = f.open()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *segment_file) open() error {
+	var err error
+	f.log, err = os.OpenFile(f.path+".log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	f.idx, err = os.OpenFile(f.path+".index", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	return err
+}
+
+// adds the record at position to the current block, writes the entry of the block once it is full
+func (f *segment_file) index_record(offset float64, position int64, length int64) error {
+	block := f.block
+	if !f.has_block {
+		block = index_entry{offset, offset, position}
+	}
+	block.min_offset = min(block.min_offset, offset)
+	block.max_offset = max(block.max_offset, offset)
+	if position+length-block.position < index_interval {
+		f.block = block
+		f.has_block = true
+		return nil
+	}
+	err := f.add_index_entry(block)
+	if err != nil {
+		return err
+	}
+	f.has_block = false
+	return nil
+}
+
+func (f *segment_file) add_index_entry(entry index_entry) error {
+	_, err := f.idx.Write(encode_index_entry(entry))
+	if err != nil {
+		// a partial entry would shift every later one
+		f.idx.Truncate(f.index_size)
+		return err
+	}
+	f.index_size += index_entry_size
+	return nil
+}
+
+// appends a message to the last segment of key, must be called with rw held
+func write_message(key string, offset float64, msg_val float64, at int64) error {
+	if data_dir == "" {
+		return nil
+	}
+	files := segment_files[key]
+	n := len(files)
+	if n == 0 || files[n-1].count >= segment_size {
+		var seq int64 = 0
+		if n > 0 {
+			seq = files[n-1].seq + 1
+			err := files[n-1].seal()
+			if err != nil {
+				return err
+			}
+		}
+		f, err := create_segment(key, seq)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		segment_files[key] = files
+		n++
+	}
+	last := files[n-1]
+
+	frame, err := encode_record(offset, msg_val, at)
+	if err != nil {
+		return err
+	}
+	_, err = last.log.Write(frame)
+	if err == nil && fsync_policy == fsync_always {
+		err = last.log.Sync()
+	}
+	if err == nil {
+		err = last.index_record(offset, last.size, int64(len(frame)))
+	}
+	if err != nil {
+		// drop the record, the send fails and recovery must not bring it back
+		last.log.Truncate(last.size)
+		if fsync_policy == fsync_always {
+			last.log.Sync()
+		}
+		return err
+	}
+	last.size += int64(len(frame))
+	last.count++
+	last.max_offset = max(last.max_offset, offset)
+	return nil
+}
+
+func (f *segment_file) seal() error {
+	var err error = nil
+	if f.has_block {
+		err = f.add_index_entry(f.block)
+		f.has_block = false
+	}
+	if err == nil {
+		err = f.log.Sync()
+	}
+	if err == nil {
+		err = f.idx.Sync()
+	}
+	f.log.Close()
+	f.idx.Close()
+	f.log = nil
+	f.idx = nil
+	return err
+}
+
+// removes the sealed segments of key that only hold messages below earliest, must be called with rw held
+func drop_segments(key string, earliest float64) error {
+	files := segment_files[key]
+	kept := make([]*segment_file, 0, len(files))
+	for i, f := range files {
+		if i == len(files)-1 || f.max_offset >= earliest {
+			kept = append(kept, f)
+			continue
+		}
+		for _, ext := range []string{".log", ".index"} {
+			err := os.Remove(f.path + ext)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	segment_files[key] = kept
+	return nil
+}
+
+// writes the committed offsets to a new file, which replaces the old one by rename. must be called with rw held
+func save_committed_offsets() error {
+	if data_dir == "" {
+		return nil
+	}
+	buf, err := json.Marshal(committed_offsets)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(get_node_dir(), "committed.json")
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf)
+	if err == nil && fsync_policy == fsync_always {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// replays the segments of every key into the cache, must run before the node serves requests
+func recover_messages() error {
+	err := os.MkdirAll(get_node_dir(), 0o755)
+	if err != nil {
+		return err
+	}
+
+	rw.Lock()
+	defer rw.Unlock()
+
+	buf, err := os.ReadFile(filepath.Join(get_node_dir(), "committed.json"))
+	if err == nil {
+		err = decode_committed_offsets(buf)
+		if err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	for group, offsets := range committed_offsets {
+		items := make(map[string]any)
+		for key, offset := range offsets {
+			items[key] = offset
+		}
+		gossip_commit(group, items)
+	}
+
+	entries, err := os.ReadDir(get_node_dir())
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		raw, err := hex.DecodeString(entry.Name())
+		if err != nil {
+			continue
+		}
+		err = recover_key(string(raw), filepath.Join(get_node_dir(), entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Recovered %d messages of %d keys", len(messages), len(segment_files))
+	return nil
+}
+
+func recover_key(key string, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	seqs := make([]int64, 0)
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".log")
+		if !ok {
+			continue
+		}
+		seq, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool {
+		return seqs[i] < seqs[j]
+	})
+
+	files := make([]*segment_file, 0, len(seqs))
+	for i, seq := range seqs {
+		f := &segment_file{path: get_segment_path(dir, seq), seq: seq}
+		data, err := os.ReadFile(f.path + ".log")
+		if err != nil {
+			return err
+		}
+		records, positions, valid := decode_records(data)
+		if i == len(seqs)-1 {
+			err = f.recover_last(records, positions, valid, int64(len(data)))
+		} else {
+			err = f.recover_sealed()
+		}
+		if err != nil {
+			return err
+		}
+		for _, item := range records {
+			cache_message(key, item[0], item[1], int64(item[2]))
+			// peers may not have acked it before the restart
+			gossip_message(key, item[0], item[1])
+			latest_offsets[key] = max(latest_offsets[key], item[0])
+		}
+		files = append(files, f)
+	}
+	if len(files) > 0 {
+		segment_files[key] = files
+	}
+	return nil
+}
+
+// takes the offsets a sealed segment holds from its index
+func (f *segment_file) recover_sealed() error {
+	data, err := os.ReadFile(f.path + ".index")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range decode_index(data) {
+		f.max_offset = max(f.max_offset, entry.max_offset)
+	}
+	return nil
+}
+
+// truncates a torn record at the end of the last segment, rebuilds its index and opens it for writing
+func (f *segment_file) recover_last(records [][]float64, positions []int64, valid int64, size int64) error {
+	err := f.open()
+	if err != nil {
+		return err
+	}
+	if valid < size {
+		log.Printf("Truncating segment %s at %d, %d bytes of a torn record", f.path, valid, size-valid)
+		err = f.log.Truncate(valid)
+		if err != nil {
+			return err
+		}
+	}
+	err = f.idx.Truncate(0)
+	if err != nil {
+		return err
+	}
+	for i, item := range records {
+		end := valid
+		if i+1 < len(positions) {
+			end = positions[i+1]
+		}
+		err = f.index_record(item[0], positions[i], end-positions[i])
+		if err != nil {
+			return err
+		}
+		f.max_offset = max(f.max_offset, item[0])
+	}
+	f.size = valid
+	f.count = len(records)
+	return nil
+}
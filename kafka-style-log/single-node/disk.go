@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+----- Durability -----
+
+Enabled by setting KAFKA_DATA_DIR, every key keeps its segments in
+KAFKA_DATA_DIR/<node id>/<hex encoded key>/, modelled on Kafka's log layout.
+
+	<base>.log    records of the segment, [length uint32][crc32 uint32][json [offset, value, at]]
+	<base>.index  sparse index, an entry [offset float64][position int64] for the first record
+	              and then every index_interval bytes of the log
+
+base is the first offset of the segment, zero padded. Only the last segment of a key is
+written to. A full segment is synced and sealed, from then on its events are read from
+disk starting at the closest index entry at or before the wanted offset.
+
+Recovery trusts the sealed segments and scans only the last segment of every key.
+A partially written record at its end is truncated and its index is rebuilt.
+committed.json in the node directory holds the committed offsets of every group.
+
+Fsync policy, set by KAFKA_FSYNC
+
+	always - fsync the segment before a send is acked (default)
+	none   - leave flushing to the OS
+
+Events dropped by retention stay in their file until the whole segment is dropped,
+after a restart they are retained again until retention drops them once more.
+*/
+
+const fsync_always string = "always"
+const fsync_none string = "none"
+
+const record_header_size = 8
+const index_entry_size = 16
+const index_interval = 4096
+
+var data_dir string = ""
+var fsync_policy string = fsync_always
+
+type index_entry struct {
+	offset   float64
+	position int64
+}
+
+type segment_file struct {
+	path         string // without extension
+	log          *os.File
+	idx          *os.File
+	size         int64
+	index        []index_entry
+	last_indexed int64
+}
+
+func get_node_dir() string {
+	return filepath.Join(data_dir, node.ID())
+}
+
+func get_key_dir(key string) string {
+	return filepath.Join(get_node_dir(), hex.EncodeToString([]byte(key)))
+}
+
+func get_segment_path(dir string, base float64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d", int64(base)))
+}
+
+func encode_record(event Event) ([]byte, error) {
+	payload, err := json.Marshal([]any{event.offset, event.value, event.at})
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, record_header_size, record_header_size+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	return append(frame, payload...), nil
+}
+
+/*
+Decodes the records at the start of data.
+Returns the events, the position of every record and the length of the valid prefix,
+everything after it is a torn write.
+*/
+func decode_records(data []byte) ([]Event, []int64, int64) {
+	events := make([]Event, 0)
+	positions := make([]int64, 0)
+	var position int64 = 0
+	for int64(len(data))-position >= record_header_size {
+		header := data[position : position+record_header_size]
+		length := int64(binary.BigEndian.Uint32(header[0:4]))
+		checksum := binary.BigEndian.Uint32(header[4:8])
+		if int64(len(data))-position-record_header_size < length {
+			break
+		}
+		payload := data[position+record_header_size : position+record_header_size+length]
+		if crc32.ChecksumIEEE(payload) != checksum {
+			break
+		}
+		var item []float64
+		if json.Unmarshal(payload, &item) != nil || len(item) != 3 {
+			break
+		}
+		events = append(events, Event{item[0], item[1], int64(item[2])})
+		positions = append(positions, position)
+		position += record_header_size + length
+	}
+	return events, positions, position
+}
+
+func encode_index_entry(entry index_entry) []byte {
+	buf := make([]byte, index_entry_size)
+	binary.BigEndian.PutUint64(buf[0:8], math.Float64bits(entry.offset))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(entry.position))
+	return buf
+}
+
+func decode_index(data []byte) []index_entry {
+	index := make([]index_entry, 0, len(data)/index_entry_size)
+	for i := 0; i+index_entry_size <= len(data); i += index_entry_size {
+		offset := math.Float64frombits(binary.BigEndian.Uint64(data[i : i+8]))
+		position := int64(binary.BigEndian.Uint64(data[i+8 : i+16]))
+		index = append(index, index_entry{offset, position})
+	}
+	return index
+}
+
+func create_segment_file(key string, base float64) (*segment_file, error) {
+	dir := get_key_dir(key)
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	f := &segment_file{path: get_segment_path(dir, base)}
+	err = f.open()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *segment_file) open() error {
+	var err error
+	f.log, err = os.OpenFile(f.path+".log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	f.idx, err = os.OpenFile(f.path+".index", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	return err
+}
+
+func (f *segment_file) add_index_entry(entry index_entry) error {
+	_, err := f.idx.Write(encode_index_entry(entry))
+	if err != nil {
+		return err
+	}
+	f.index = append(f.index, entry)
+	f.last_indexed = entry.position
+	return nil
+}
+
+func (f *segment_file) write(event Event) error {
+	frame, err := encode_record(event)
+	if err != nil {
+		return err
+	}
+	_, err = f.log.Write(frame)
+	if err == nil && fsync_policy == fsync_always {
+		err = f.log.Sync()
+	}
+	if err != nil {
+		f.drop_last_record()
+		return err
+	}
+	// the index only has to be right for sealed segments, recovery rebuilds the last one
+	if len(f.index) == 0 || f.size-f.last_indexed >= index_interval {
+		err = f.add_index_entry(index_entry{event.offset, f.size})
+		if err != nil {
+			// the record is already synced, it goes too or it would be sealed without an entry
+			f.drop_last_record()
+			f.idx.Truncate(int64(len(f.index) * index_entry_size))
+			return err
+		}
+	}
+	f.size += int64(len(frame))
+	return nil
+}
+
+/*
+Drops a record written after f.size, the send fails and recovery must not bring it back.
+Later records must not land behind it either, positions in the index would be off.
+*/
+func (f *segment_file) drop_last_record() {
+	f.log.Truncate(f.size)
+	if fsync_policy == fsync_always {
+		f.log.Sync()
+	}
+}
+
+func (f *segment_file) seal() error {
+	err := f.log.Sync()
+	if err == nil {
+		err = f.idx.Sync()
+	}
+	f.log.Close()
+	f.idx.Close()
+	f.log, f.idx = nil, nil
+	return err
+}
+
+// calls fn on the events of the file from offset on, until fn returns false
+func (f *segment_file) scan(offset float64, fn func(Event) bool) (bool, error) {
+	i := sort.Search(len(f.index), func(i int) bool {
+		return f.index[i].offset > offset
+	})
+	var position int64 = 0
+	if i > 0 {
+		position = f.index[i-1].position
+	}
+
+	file, err := os.Open(f.path + ".log")
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	_, err = file.Seek(position, io.SeekStart)
+	if err != nil {
+		return false, err
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return false, err
+	}
+
+	events, _, _ := decode_records(data)
+	for _, event := range events {
+		if event.offset < offset {
+			continue
+		}
+		if !fn(event) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (f *segment_file) remove() error {
+	if f.log != nil {
+		f.seal()
+	}
+	err := os.Remove(f.path + ".log")
+	if err != nil {
+		return err
+	}
+	return os.Remove(f.path + ".index")
+}
+
+// writes the committed offsets to a new file, which replaces the old one by rename
+func save_committed_offsets() error {
+	if data_dir == "" {
+		return nil
+	}
+	buf, err := json.Marshal(committed_offsets)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(get_node_dir(), "committed.json")
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf)
+	if err == nil && fsync_policy == fsync_always {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// loads the segments of every key and the committed offsets, must run before the node serves requests
+func recover_logs() error {
+	err := os.MkdirAll(get_node_dir(), 0o755)
+	if err != nil {
+		return err
+	}
+
+	buf, err := os.ReadFile(filepath.Join(get_node_dir(), "committed.json"))
+	if err == nil {
+		err = decode_committed_offsets(buf)
+		if err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	entries, err := os.ReadDir(get_node_dir())
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		raw, err := hex.DecodeString(entry.Name())
+		if err != nil {
+			continue
+		}
+		l, err := recover_key_log(filepath.Join(get_node_dir(), entry.Name()))
+		if err != nil {
+			return err
+		}
+		if l != nil {
+			logs[string(raw)] = l
+		}
+	}
+	log.Printf("Recovered the logs of %d keys", len(logs))
+	return nil
+}
+
+// nil if the key has no segments
+func recover_key_log(dir string) (*key_log, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	bases := make([]float64, 0)
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".log")
+		if !ok {
+			continue
+		}
+		base, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		bases = append(bases, float64(base))
+	}
+	if len(bases) == 0 {
+		return nil, nil
+	}
+	sort.Float64s(bases)
+
+	l := &key_log{}
+	for i, base := range bases[:len(bases)-1] {
+		f := &segment_file{path: get_segment_path(dir, base)}
+		info, err := os.Stat(f.path + ".log")
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(f.path + ".index")
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		f.index = decode_index(data)
+		f.size = info.Size()
+		next := bases[i+1]
+		seg := &segment{base, base, next, int(f.size), info.ModTime().UnixMilli(), nil, f}
+		l.segments = append(l.segments, seg)
+		l.count += seg.count()
+		l.bytes += seg.bytes
+	}
+
+	seg, err := recover_last_segment(dir, bases[len(bases)-1])
+	if err != nil {
+		return nil, err
+	}
+	l.segments = append(l.segments, seg)
+	l.count += seg.count()
+	l.bytes += seg.bytes
+	l.next = seg.next
+	return l, nil
+}
+
+// scans the last segment of a key, truncates a torn record and rebuilds its index
+func recover_last_segment(dir string, base float64) (*segment, error) {
+	f := &segment_file{path: get_segment_path(dir, base)}
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f.log)
+	if err != nil {
+		return nil, err
+	}
+
+	events, positions, valid := decode_records(data)
+	if valid < int64(len(data)) {
+		log.Printf("Truncating segment %s.log at %d, %d bytes of a torn record", f.path, valid, int64(len(data))-valid)
+		err = f.log.Truncate(valid)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = f.idx.Truncate(0)
+	if err != nil {
+		return nil, err
+	}
+	for i, event := range events {
+		if len(f.index) == 0 || positions[i]-f.last_indexed >= index_interval {
+			err = f.add_index_entry(index_entry{event.offset, positions[i]})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	f.size = valid
+
+	seg := &segment{base, base, base, int(valid), 0, events, f}
+	if len(events) > 0 {
+		seg.next = events[len(events)-1].offset + 1
+		seg.last_at = events[len(events)-1].at
+	}
+	return seg, nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"log"
+	"os"
 	"sync"
 
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
@@ -13,26 +14,8 @@ import (
 var node *maelstrom.Node
 var rw sync.RWMutex = sync.RWMutex{} // ReadWrite Mutex
 
-/*
------ STRUCT -----
-linked list
-*/
-
-type Event struct {
-	offset float64
-	value  float64
-	next   *Event
-}
-
-var msgs_tail map[string]Event = make(map[string]Event)
-var msgs_head map[string]Event = make(map[string]Event)
-
-func (event Event) to_list() []float64 {
-	result := make([]float64, 0)
-	result = append(result, event.offset)
-	result = append(result, event.value)
-	return result
-}
+// key -> log of the key, see segments.go
+var logs map[string]*key_log = make(map[string]*key_log)
 
 /*
 -----------
@@ -50,14 +33,16 @@ func get_body_from_msg(msg maelstrom.Message) map[string]any {
 	return body
 }
 
-func get_recent_msg(key string) (Event, bool) {
-	rw.RLock()
-	event, ok := msgs_tail[key]
-	rw.RUnlock()
-	if !ok {
-		return Event{}, false
+// max_messages and max_bytes of a poll, both optional and per key
+func get_budget_from_body(body map[string]any) read_budget {
+	var budget read_budget
+	if value, ok := body["max_messages"].(float64); ok {
+		budget.max_messages = int(value)
+	}
+	if value, ok := body["max_bytes"].(float64); ok {
+		budget.max_bytes = int(value)
 	}
-	return event, true
+	return budget
 }
 
 /*
@@ -66,27 +51,22 @@ func get_recent_msg(key string) (Event, bool) {
 ------------------
 */
 
-var offset float64 = 0
-var committed_offsets map[string]float64 = make(map[string]float64)
-
 func handle_send(msg maelstrom.Message) error {
 	body := get_body_from_msg(msg)
 	var key string = body["key"].(string)
 	msg_val := body["msg"].(float64)
 
-	val, ok := get_recent_msg(key)
-	curr_event := Event{offset, msg_val, nil}
-
 	rw.Lock()
+	l, ok := logs[key]
 	if !ok {
-		msgs_head[key] = curr_event
-		msgs_tail[key] = curr_event
-	} else {
-		val.next = &curr_event
-		msgs_tail[key] = curr_event
+		l = &key_log{}
+		logs[key] = l
+	}
+	offset, err := l.append(key, msg_val)
+	if err != nil {
+		rw.Unlock()
+		return err
 	}
-
-	offset++
 
 	reply := make(map[string]any)
 	reply["type"] = "send_ok"
@@ -103,23 +83,29 @@ func handle_poll(msg maelstrom.Message) error {
 
 	var offsets map[string]any = body["offsets"].(map[string]any)
 	var results map[string][][]float64 = make(map[string][][]float64)
+	budget := get_budget_from_body(body)
 
+	rw.RLock()
 	for key, req_offset := range offsets {
-		rw.RLock()
-		event := msgs_head[key]
-		for event.next != nil {
-			if event.offset >= req_offset.(float64) {
-				result, ok := results[key]
-				if !ok {
-					result = make([][]float64, 0)
-				}
-				result = append(result, event.to_list())
-				results[key] = result
-			}
-			event = *event.next
+		l, ok := logs[key]
+		if !ok {
+			continue
 		}
-		rw.RUnlock()
+		events, err := l.read_from(req_offset.(float64), budget)
+		if err != nil {
+			rw.RUnlock()
+			return err
+		}
+		if len(events) == 0 {
+			continue
+		}
+		result := make([][]float64, 0, len(events))
+		for _, event := range events {
+			result = append(result, event.to_list())
+		}
+		results[key] = result
 	}
+	rw.RUnlock()
 
 	var reply map[string]any = make(map[string]any)
 	reply["type"] = "poll_ok"
@@ -131,25 +117,22 @@ func handle_poll(msg maelstrom.Message) error {
 func handle_commit_offsets(msg maelstrom.Message) error {
 	body := get_body_from_msg(msg)
 	var offsets map[string]any = body["offsets"].(map[string]any)
+	group := get_group_from_body(body)
 
+	rw.Lock()
+	committed := get_group_offsets(group)
 	for key, off_float := range offsets {
 		commit_offset := off_float.(float64)
-		event := msgs_head[key]
-		if commit_offset == msgs_tail[key].offset {
-			delete(msgs_head, key)
-			delete(msgs_tail, key)
-		} else {
-			for event.next != nil {
-				if event.offset <= commit_offset {
-					next := *event.next
-					event.next = nil
-
-					msgs_head[key] = next
-					event = next
-				}
-			}
+		// commits never move back
+		if current, ok := committed[key]; ok && current >= commit_offset {
+			continue
 		}
-		committed_offsets[key] = commit_offset
+		committed[key] = commit_offset
+	}
+	err := save_committed_offsets()
+	rw.Unlock()
+	if err != nil {
+		return err
 	}
 
 	var reply map[string]string = make(map[string]string)
@@ -159,18 +142,45 @@ func handle_commit_offsets(msg maelstrom.Message) error {
 }
 
 func handle_list_committed_offsets(msg maelstrom.Message) error {
+	body := get_body_from_msg(msg)
 	var reply map[string]any = make(map[string]any)
 	reply["type"] = "list_committed_offsets_ok"
-	reply["offsets"] = committed_offsets
-	return node.Reply(msg, reply)
+	rw.RLock()
+	offsets, ok := committed_offsets[get_group_from_body(body)]
+	if !ok {
+		offsets = make(map[string]float64)
+	}
+	reply["offsets"] = offsets
+	err := node.Reply(msg, reply)
+	rw.RUnlock()
+	return err
 }
 
 func main() {
 	node = maelstrom.NewNode()
+	init_default_retention()
+	data_dir = os.Getenv("KAFKA_DATA_DIR")
+	if value, ok := os.LookupEnv("KAFKA_FSYNC"); ok {
+		if value != fsync_always && value != fsync_none {
+			log.Fatalf("unknown fsync policy %s", value)
+		}
+		fsync_policy = value
+	}
+	node.Handle("init", func(msg maelstrom.Message) error {
+		if data_dir == "" {
+			return nil
+		}
+		return recover_logs()
+	})
 	node.Handle("send", handle_send)
 	node.Handle("poll", handle_poll)
 	node.Handle("commit_offsets", handle_commit_offsets)
 	node.Handle("list_committed_offsets", handle_list_committed_offsets)
+	node.Handle("list_groups", handle_list_groups)
+	node.Handle("group_lag", handle_group_lag)
+	node.Handle("set_retention", handle_set_retention)
+	node.Handle("list_offsets", handle_list_offsets)
+	init_retention_routine()
 	err := node.Run()
 	if err != nil {
 		log.Fatal(err)
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+/*
+----- Retention -----
+
+Every key has a retention policy, the default one comes from the environment
+
+	KAFKA_RETENTION_MESSAGES  keep at most this many messages of a key
+	KAFKA_RETENTION_MS        keep messages for at most this many ms
+	KAFKA_RETENTION_BYTES     keep at most this many bytes of messages of a key, as stored
+
+A limit of 0 or an unset variable means no limit, by default the log grows forever.
+set_retention replaces the policy of a key, or the default without a key.
+
+Every retention_interval the oldest messages of every key are dropped until its log is
+within its limits. A message above the lowest committed offset of its key is never dropped,
+or any message if no group committed the key, unless the policy has force set.
+*/
+
+const retention_interval = 1 * time.Second
+
+type retention_policy struct {
+	max_messages int
+	max_age_ms   int64
+	max_bytes    int
+	force        bool // drop messages that aren't committed yet
+}
+
+// guarded by rw
+var default_retention retention_policy
+var retention map[string]retention_policy = make(map[string]retention_policy)
+
+func get_env_limit(name string) int64 {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return 0
+	}
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || limit < 0 {
+		log.Fatalf("%s must be a number >= 0", name)
+	}
+	return limit
+}
+
+func init_default_retention() {
+	default_retention.max_messages = int(get_env_limit("KAFKA_RETENTION_MESSAGES"))
+	default_retention.max_age_ms = get_env_limit("KAFKA_RETENTION_MS")
+	default_retention.max_bytes = int(get_env_limit("KAFKA_RETENTION_BYTES"))
+}
+
+func get_policy(key string) retention_policy {
+	if policy, ok := retention[key]; ok {
+		return policy
+	}
+	return default_retention
+}
+
+// drops the oldest events of key that are over its limits, must be called with rw held
+func apply_retention(key string, l *key_log, now int64) error {
+	policy := get_policy(key)
+	cutoff := l.earliest()
+
+	if policy.max_messages > 0 && l.count > policy.max_messages {
+		// offsets are dense, the last max_messages events start here
+		cutoff = max(cutoff, l.next-float64(policy.max_messages))
+	}
+	if policy.max_age_ms > 0 || policy.max_bytes > 0 {
+		bytes := l.bytes
+		err := l.scan(l.earliest(), func(event Event) bool {
+			too_old := policy.max_age_ms > 0 && now-event.at > policy.max_age_ms
+			too_big := policy.max_bytes > 0 && bytes > policy.max_bytes
+			if !too_old && !too_big {
+				return false
+			}
+			cutoff = max(cutoff, event.offset+1)
+			bytes -= event.record_size()
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if !policy.force {
+		committed, ok := get_lowest_committed(key)
+		if !ok {
+			return nil
+		}
+		cutoff = min(cutoff, committed+1)
+	}
+	return l.drop_before(cutoff)
+}
+
+func init_retention_routine() {
+	go func() {
+		for {
+			time.Sleep(retention_interval)
+			now := time.Now().UnixMilli()
+			rw.Lock()
+			for key, l := range logs {
+				err := apply_retention(key, l, now)
+				if err != nil {
+					log.Printf("ERROR applying retention to %s: %s", key, err)
+				}
+			}
+			rw.Unlock()
+		}
+	}()
+}
+
+/*
+------------------
+   RPC Handlers
+------------------
+*/
+
+func handle_set_retention(msg maelstrom.Message) error {
+	body := get_body_from_msg(msg)
+
+	var policy retention_policy
+	if value, ok := body["max_messages"].(float64); ok {
+		policy.max_messages = int(value)
+	}
+	if value, ok := body["max_age_ms"].(float64); ok {
+		policy.max_age_ms = int64(value)
+	}
+	if value, ok := body["max_bytes"].(float64); ok {
+		policy.max_bytes = int(value)
+	}
+	policy.force, _ = body["force"].(bool)
+
+	rw.Lock()
+	var err error
+	if key, ok := body["key"].(string); ok {
+		retention[key] = policy
+		if l, ok := logs[key]; ok {
+			err = apply_retention(key, l, time.Now().UnixMilli())
+		}
+	} else {
+		default_retention = policy
+	}
+	rw.Unlock()
+	if err != nil {
+		return err
+	}
+
+	var reply map[string]any = make(map[string]any)
+	reply["type"] = "set_retention_ok"
+	return node.Reply(msg, reply)
+}
+
+// earliest and latest offset still in the log of every key, latest is below earliest if all were dropped
+func handle_list_offsets(msg maelstrom.Message) error {
+	body := get_body_from_msg(msg)
+
+	var results map[string]any = make(map[string]any)
+	rw.RLock()
+	keys := make([]string, 0)
+	if list, ok := body["keys"].([]any); ok {
+		for _, key := range list {
+			keys = append(keys, key.(string))
+		}
+	} else {
+		for key := range logs {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		l, ok := logs[key]
+		if !ok {
+			continue
+		}
+		var offsets map[string]float64 = make(map[string]float64)
+		offsets["earliest"] = l.earliest()
+		offsets["latest"] = l.next - 1
+		results[key] = offsets
+	}
+	rw.RUnlock()
+
+	var reply map[string]any = make(map[string]any)
+	reply["type"] = "list_offsets_ok"
+	reply["offsets"] = results
+	return node.Reply(msg, reply)
+}
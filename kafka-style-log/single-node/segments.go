@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+/*
+----- Log Storage -----
+
+Every key has its own append-only log, split into segments of up to segment_size events.
+Offsets are per key, they start at 0 and every append takes the next one, so a segment
+covers a contiguous range of offsets starting at its base offset.
+
+A seek finds the segment by binary search over the base offsets, then the event by
+binary search inside the segment, or through the sparse index of a segment that is
+sealed on disk (see disk.go), O(log n) in the number of events of the key.
+
+Retention drops events from the front of the log (see retention.go). start is the first
+offset of a segment that is still retained, a segment is removed once all of its events
+are dropped. The last segment is always kept, it holds the next offset of the key.
+*/
+
+const segment_size = 1024
+
+type Event struct {
+	offset float64
+	value  float64
+	at     int64 // append time, unix ms
+}
+
+type segment struct {
+	base    float64
+	start   float64 // first retained offset
+	next    float64 // offset after the last event
+	bytes   int     // record size of the retained events
+	last_at int64   // append time of the newest event
+	events  []Event // retained events, nil once the segment is sealed on disk
+	file    *segment_file
+}
+
+type key_log struct {
+	segments []*segment
+	next     float64 // offset of the next append
+	count    int     // retained events
+	bytes    int     // record size of the retained events
+}
+
+// limits of a read, 0 means no limit
+type read_budget struct {
+	max_messages int
+	max_bytes    int
+}
+
+func (event Event) to_list() []float64 {
+	result := make([]float64, 0)
+	result = append(result, event.offset)
+	result = append(result, event.value)
+	return result
+}
+
+// size of the message in bytes, as json
+func (event Event) size() int {
+	buf, _ := json.Marshal(event.value)
+	return len(buf)
+}
+
+// size of the event as it is stored, which retention counts
+func (event Event) record_size() int {
+	frame, _ := encode_record(event)
+	return len(frame)
+}
+
+func (seg *segment) count() int {
+	return int(seg.next - seg.start)
+}
+
+// calls fn on the retained events of seg from offset on, in offset order, until fn returns false
+func (seg *segment) scan(offset float64, fn func(Event) bool) (bool, error) {
+	offset = max(offset, seg.start)
+	if seg.events == nil {
+		return seg.file.scan(offset, fn)
+	}
+	j := sort.Search(len(seg.events), func(j int) bool {
+		return seg.events[j].offset >= offset
+	})
+	for _, event := range seg.events[j:] {
+		if !fn(event) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// appends a message at the next offset of the log, returns the offset
+func (l *key_log) append(key string, value float64) (float64, error) {
+	n := len(l.segments)
+	if n == 0 || l.segments[n-1].next-l.segments[n-1].base >= segment_size {
+		seg, err := l.roll(key)
+		if err != nil {
+			return 0, err
+		}
+		l.segments = append(l.segments, seg)
+		n++
+	}
+	last := l.segments[n-1]
+
+	event := Event{l.next, value, time.Now().UnixMilli()}
+	if last.file != nil {
+		err := last.file.write(event)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if last.events != nil {
+		last.events = append(last.events, event)
+	}
+	size := event.record_size()
+	last.next++
+	last.bytes += size
+	last.last_at = event.at
+	l.next++
+	l.count++
+	l.bytes += size
+	return event.offset, nil
+}
+
+// seals the last segment and starts a new one at the next offset
+func (l *key_log) roll(key string) (*segment, error) {
+	seg := &segment{l.next, l.next, l.next, 0, 0, make([]Event, 0, segment_size), nil}
+	if data_dir == "" {
+		return seg, nil
+	}
+	if n := len(l.segments); n > 0 {
+		last := l.segments[n-1]
+		err := last.file.seal()
+		if err != nil {
+			return nil, err
+		}
+		last.events = nil
+	}
+	file, err := create_segment_file(key, l.next)
+	if err != nil {
+		return nil, err
+	}
+	seg.file = file
+	return seg, nil
+}
+
+// calls fn on every retained event with an offset >= offset, in offset order, until fn returns false
+func (l *key_log) scan(offset float64, fn func(Event) bool) error {
+	// first segment starting after offset, the event can only be in the one before it or later
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].base > offset
+	})
+	if i > 0 {
+		i--
+	}
+	for ; i < len(l.segments); i++ {
+		more, err := l.segments[i].scan(offset, fn)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Events with an offset >= offset in offset order, as many as budget allows.
+The first event is returned even if it is larger than max_bytes, so a consumer never gets stuck.
+*/
+func (l *key_log) read_from(offset float64, budget read_budget) ([]Event, error) {
+	result := make([]Event, 0)
+	bytes := 0
+	err := l.scan(offset, func(event Event) bool {
+		if budget.max_messages > 0 && len(result) >= budget.max_messages {
+			return false
+		}
+		bytes += event.size()
+		if budget.max_bytes > 0 && bytes > budget.max_bytes && len(result) > 0 {
+			return false
+		}
+		result = append(result, event)
+		return true
+	})
+	return result, err
+}
+
+// offset of the first retained event, next if there is none
+func (l *key_log) earliest() float64 {
+	if len(l.segments) == 0 {
+		return l.next
+	}
+	return l.segments[0].start
+}
+
+// drops every event with an offset below offset
+func (l *key_log) drop_before(offset float64) error {
+	for len(l.segments) > 0 {
+		first := l.segments[0]
+		if offset <= first.start {
+			return nil
+		}
+		if first.next <= offset && len(l.segments) > 1 {
+			l.count -= first.count()
+			l.bytes -= first.bytes
+			if first.file != nil {
+				err := first.file.remove()
+				if err != nil {
+					return err
+				}
+			}
+			l.segments = l.segments[1:]
+			continue
+		}
+
+		cut := min(offset, first.next)
+		dropped := 0
+		_, err := first.scan(first.start, func(event Event) bool {
+			if event.offset >= cut {
+				return false
+			}
+			dropped += event.record_size()
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		if first.events != nil {
+			first.events = first.events[int(cut-first.start):]
+		}
+		l.count -= int(cut - first.start)
+		l.bytes -= dropped
+		first.bytes -= dropped
+		first.start = cut
+		return nil
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+func TestMain(m *testing.M) {
+	node = maelstrom.NewNode()
+	node.Init("n1", []string{"n1"})
+	os.Exit(m.Run())
+}
+
+// a log of count events with value 1000 + offset, in memory or with segments sealed on disk
+func get_test_log(t *testing.T, on_disk bool, count int) *key_log {
+	data_dir = ""
+	if on_disk {
+		data_dir = t.TempDir()
+		fsync_policy = fsync_none
+		t.Cleanup(func() {
+			data_dir = ""
+			fsync_policy = fsync_always
+		})
+	}
+	l := &key_log{}
+	for i := 0; i < count; i++ {
+		offset, err := l.append("k", float64(1000+i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset != float64(i) {
+			t.Fatalf("append %d got offset %v", i, offset)
+		}
+	}
+	return l
+}
+
+// checks that reading from offset returns the events from first to last, inclusive
+func check_read(t *testing.T, l *key_log, offset float64, budget read_budget, first float64, last float64) {
+	t.Helper()
+	events, err := l.read_from(offset, budget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(last-first+1) != len(events) {
+		t.Fatalf("read from %v with %+v: got %d events, want offsets %v to %v", offset, budget, len(events), first, last)
+	}
+	for i, event := range events {
+		want := first + float64(i)
+		if event.offset != want || event.value != 1000+want {
+			t.Fatalf("read from %v with %+v: event %d is [%v %v], want [%v %v]",
+				offset, budget, i, event.offset, event.value, want, 1000+want)
+		}
+	}
+}
+
+func for_each_storage(t *testing.T, fn func(t *testing.T, on_disk bool)) {
+	t.Run("memory", func(t *testing.T) { fn(t, false) })
+	t.Run("disk", func(t *testing.T) { fn(t, true) })
+}
+
+func TestReadFrom(t *testing.T) {
+	for_each_storage(t, func(t *testing.T, on_disk bool) {
+		count := 3*segment_size + 10
+		end := float64(count - 1)
+		l := get_test_log(t, on_disk, count)
+		if len(l.segments) != 4 {
+			t.Fatalf("log has %d segments, want 4", len(l.segments))
+		}
+		none := read_budget{}
+
+		check_read(t, l, 0, none, 0, end)
+		// mid segment
+		check_read(t, l, 500, none, 500, end)
+		check_read(t, l, segment_size+700, none, segment_size+700, end)
+		// last event of a segment and first of the next
+		check_read(t, l, segment_size-1, none, segment_size-1, end)
+		check_read(t, l, segment_size, none, segment_size, end)
+		check_read(t, l, 2*segment_size, none, 2*segment_size, end)
+		// last event of the key
+		check_read(t, l, end, none, end, end)
+		// past the end
+		check_read(t, l, end+1, none, 1, 0)
+		check_read(t, l, end+100, none, 1, 0)
+	})
+}
+
+func TestReadFromAfterRetention(t *testing.T) {
+	for_each_storage(t, func(t *testing.T, on_disk bool) {
+		count := 3*segment_size + 10
+		end := float64(count - 1)
+		l := get_test_log(t, on_disk, count)
+		none := read_budget{}
+
+		// mid segment, the segment before it is removed
+		earliest := float64(segment_size + 100)
+		err := l.drop_before(earliest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l.earliest() != earliest {
+			t.Fatalf("earliest is %v, want %v", l.earliest(), earliest)
+		}
+		if l.count != count-int(earliest) {
+			t.Fatalf("count is %d, want %d", l.count, count-int(earliest))
+		}
+
+		// before earliest
+		check_read(t, l, 0, none, earliest, end)
+		check_read(t, l, earliest-1, none, earliest, end)
+		check_read(t, l, earliest, none, earliest, end)
+		check_read(t, l, earliest+1, none, earliest+1, end)
+		check_read(t, l, end, none, end, end)
+
+		// on a segment boundary
+		err = l.drop_before(2 * segment_size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check_read(t, l, 0, none, 2*segment_size, end)
+		check_read(t, l, 2*segment_size-1, none, 2*segment_size, end)
+	})
+}
+
+func TestReadFromBudget(t *testing.T) {
+	for_each_storage(t, func(t *testing.T, on_disk bool) {
+		count := 2*segment_size + 10
+		l := get_test_log(t, on_disk, count)
+		// every value is 4 bytes as json
+		size := Event{0, 1000, 0}.size()
+		if size != 4 {
+			t.Fatalf("test values are %d bytes, want 4", size)
+		}
+
+		check_read(t, l, 100, read_budget{max_messages: 10}, 100, 109)
+		// across a segment boundary
+		check_read(t, l, segment_size-5, read_budget{max_messages: 10}, segment_size-5, segment_size+4)
+		// fewer left than the budget
+		check_read(t, l, float64(count-3), read_budget{max_messages: 10}, float64(count-3), float64(count-1))
+
+		check_read(t, l, 100, read_budget{max_bytes: 10 * size}, 100, 109)
+		check_read(t, l, 100, read_budget{max_bytes: 10*size + size - 1}, 100, 109)
+		check_read(t, l, segment_size-2, read_budget{max_bytes: 4 * size}, segment_size-2, segment_size+1)
+		// the first event is returned even if it doesn't fit
+		check_read(t, l, 100, read_budget{max_bytes: 1}, 100, 100)
+
+		// the tighter limit wins
+		check_read(t, l, 100, read_budget{max_messages: 3, max_bytes: 10 * size}, 100, 102)
+		check_read(t, l, 100, read_budget{max_messages: 30, max_bytes: 5 * size}, 100, 104)
+	})
+}
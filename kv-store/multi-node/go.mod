@@ -0,0 +1,5 @@
+module maelstrom-txn
+
+go 1.23.0
+
+require github.com/jepsen-io/maelstrom/demo/go v0.0.0-20240813160128-8b9e94c75e59
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+/*
+
+Strategy:
+
+Every node accepts txns locally and never waits on other nodes, so the service stays
+available during partitions. Isolation is read uncommitted or read committed, set by KV_ISOLATION.
+
+Txn Handler (read uncommitted):
+
+- Take a hybrid logical clock (HLC) timestamp for the txn
+- Execute the ops against the local store, writes are applied as they execute
+- Ack the txn
+- Queue the final value of every written key for replication to all peers
+
+Txn Handler (read committed):
+
+- Execute the ops against the local store, writes are buffered in the txn
+  and reads see the txn's own writes
+- Take the txn timestamp after all reads, so it is above every version the txn read
+- Apply the final value of every written key at once, then ack the txn
+- Queue the writes for replication to all peers
+
+Replication:
+
+- Every replication_interval, each peer is sent the writes it hasn't acked yet
+- A lost message is simply sent again in the next round, writes are idempotent
+- The receiver applies each write with last-writer-wins on the write timestamp
+
+Dirty writes (G0):
+
+All writes of a txn carry the txn timestamp, and timestamps are unique because they
+end with the node id. Every node orders the versions of every key by timestamp, so two
+txns are ordered the same way on all keys they both write and all nodes eventually
+agree on that order. A write-write cycle between txns can't form.
+
+Aborted and intermediate reads (G1a, G1b):
+
+In read committed mode only the final writes of a txn are applied, all at once and
+after it is done, and txns never abort. Replication ships the writes of a txn in the
+same batch and a batch is applied at once, so peers see a txn whole or not at all.
+A txn's timestamp is above everything it read, so write-read and write-write
+dependencies both follow timestamp order and can't form a cycle either (G1c).
+
+Expiry:
+
+A write can carry a TTL in ms. Its deadline is the wall part of the write timestamp
+plus the TTL, so every replica computes the same deadline. A key is expired once the
+node's HLC has reached the deadline, the HLC has observed the write so it never runs
+behind the writer's clock. Expired keys read as absent, the sweeper replaces them with
+tombstones that keep the timestamp for last-writer-wins and drops the tombstones after
+tombstone_retention. A replicated write older than a dropped tombstone can bring a key back.
+
+*/
+
+// GLOBALS
+var node *maelstrom.Node
+var rw sync.RWMutex
+
+const replication_interval = 100 * time.Millisecond
+const sweep_interval = 1 * time.Second
+const tombstone_retention = 60 * time.Second
+
+const read_uncommitted string = "read-uncommitted"
+const read_committed string = "read-committed"
+
+var isolation string = read_uncommitted
+
+/*
+----- Hybrid Logical Clock -----
+wall is the physical time in ms, logical orders events within the same ms.
+*/
+
+type timestamp struct {
+	wall    int64
+	logical int
+	node    string
+}
+
+var clock_mu sync.Mutex
+var last_ts timestamp
+
+func (a timestamp) less(b timestamp) bool {
+	if a.wall != b.wall {
+		return a.wall < b.wall
+	}
+	if a.logical != b.logical {
+		return a.logical < b.logical
+	}
+	return a.node < b.node
+}
+
+func (t timestamp) to_array() []any {
+	return []any{t.wall, t.logical, t.node}
+}
+
+func get_timestamp_from_body(raw any) timestamp {
+	item := raw.([]any)
+	return timestamp{int64(item[0].(float64)), int(item[1].(float64)), item[2].(string)}
+}
+
+// timestamp for a local event
+func now() timestamp {
+	clock_mu.Lock()
+	defer clock_mu.Unlock()
+	physical := time.Now().UnixMilli()
+	if physical > last_ts.wall {
+		last_ts = timestamp{physical, 0, node.ID()}
+	} else {
+		last_ts.logical++
+	}
+	return last_ts
+}
+
+// current reading of the clock without ticking it, in ms
+func read_clock() int64 {
+	clock_mu.Lock()
+	defer clock_mu.Unlock()
+	return max(time.Now().UnixMilli(), last_ts.wall)
+}
+
+// moves the clock past a timestamp received from another node
+func observe(remote timestamp) {
+	clock_mu.Lock()
+	defer clock_mu.Unlock()
+	wall := max(time.Now().UnixMilli(), last_ts.wall, remote.wall)
+	logical := 0
+	if wall == last_ts.wall && wall == remote.wall {
+		logical = max(last_ts.logical, remote.logical) + 1
+	} else if wall == last_ts.wall {
+		logical = last_ts.logical + 1
+	} else if wall == remote.wall {
+		logical = remote.logical + 1
+	}
+	last_ts = timestamp{wall, logical, node.ID()}
+}
+
+/*
+----- Store -----
+*/
+
+// val is any json value, entries are keyed by the json encoding of their key.
+// expires is the HLC wall time in ms the entry expires at, 0 if it never does
+type entry struct {
+	val     any
+	ts      timestamp
+	expires int64
+}
+
+var kv map[string]entry = make(map[string]entry)
+
+// last-writer-wins, a later write of the same txn shares its timestamp and replaces the earlier one.
+// must be called with rw held
+func apply_write(key string, val any, ts timestamp, expires int64) {
+	current, ok := kv[key]
+	if ok && ts.less(current.ts) {
+		return
+	}
+	kv[key] = entry{val, ts, expires}
+}
+
+func (e entry) expired(at int64) bool {
+	return e.expires != 0 && at >= e.expires
+}
+
+// entry of key with an absent value if it expired, must be called with rw held
+func read_entry(key string) entry {
+	current := kv[key]
+	if current.expired(read_clock()) {
+		current.val = nil
+	}
+	return current
+}
+
+// deadline of a write with ttl ms at ts, 0 if ttl is 0
+func get_expiry(ts timestamp, ttl int64) int64 {
+	if ttl == 0 {
+		return 0
+	}
+	return ts.wall + ttl
+}
+
+// replaces expired entries with tombstones and drops old tombstones
+func sweep() {
+	at := read_clock()
+	rw.Lock()
+	defer rw.Unlock()
+	for key, current := range kv {
+		if !current.expired(at) {
+			continue
+		}
+		if at-current.expires >= tombstone_retention.Milliseconds() {
+			delete(kv, key)
+		} else if current.val != nil {
+			current.val = nil
+			kv[key] = current
+		}
+	}
+}
+
+func init_sweep_routine() {
+	go func() {
+		for {
+			time.Sleep(sweep_interval)
+			sweep()
+		}
+	}()
+}
+
+/*
+-----------
+   Utils
+-----------
+*/
+
+func get_body_from_msg(msg maelstrom.Message) (map[string]any, error) {
+	var body map[string]any
+	err := json.Unmarshal(msg.Body, &body)
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+/*
+Micro-ops
+
+	["r", key, nil]       read, an expired key reads as nil
+	["w", key, val]       write
+	["w", key, val, ttl]  write that expires ttl ms after the txn timestamp
+
+Any other micro-op is rejected, append included.
+*/
+type operation struct {
+	read  bool
+	write bool
+	key   any    // any json scalar
+	id    string // json encoding of key, 1 and "1" are different keys
+	val   any
+	ttl   int64 // ms, 0 if the write doesn't expire
+}
+
+func encode_key(key any) (string, error) {
+	switch key.(type) {
+	case string, float64, bool, nil:
+	default:
+		return "", maelstrom.NewRPCError(maelstrom.MalformedRequest, "keys must be json scalars")
+	}
+	buf, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func generate_op_list(input any) ([]operation, error) {
+	var ops []operation = make([]operation, 0)
+	for _, val := range input.([]any) {
+		item := val.([]any)
+		var op operation
+		id, err := encode_key(item[1])
+		if err != nil {
+			return nil, err
+		}
+		op.key = item[1]
+		op.id = id
+		op.val = item[2]
+		switch item[0].(string) {
+		case "r":
+			op.read = true
+		case "w":
+			op.write = true
+		case "append":
+			// last-writer-wins replication would drop concurrent appends to a list
+			return nil, maelstrom.NewRPCError(maelstrom.NotSupported, "append is not supported, lists can't be merged by last-writer-wins")
+		default:
+			return nil, maelstrom.NewRPCError(maelstrom.MalformedRequest, "unknown micro-op "+item[0].(string))
+		}
+		if len(item) > 3 {
+			ttl, ok := item[3].(float64)
+			if !ok || ttl <= 0 {
+				return nil, maelstrom.NewRPCError(maelstrom.MalformedRequest, "ttl must be a positive number of ms")
+			}
+			op.ttl = int64(ttl)
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+func (op *operation) to_array() []any {
+	var array []any = make([]any, 0)
+	if op.read {
+		array = append(array, "r")
+	} else {
+		array = append(array, "w")
+	}
+	array = append(array, op.key)
+	array = append(array, op.val)
+	if op.ttl > 0 {
+		array = append(array, op.ttl)
+	}
+	return array
+}
+
+/*
+-----------------
+   Replication
+-----------------
+*/
+
+type replicated_write struct {
+	key     any
+	val     any
+	ts      timestamp
+	expires int64
+}
+
+func (w replicated_write) to_array() []any {
+	return []any{w.key, w.val, w.ts.to_array(), w.expires}
+}
+
+// pending[peer] holds the writes that peer hasn't acked yet, by write id
+var pending map[string]map[int]replicated_write = make(map[string]map[int]replicated_write)
+var next_write_id int = 0
+
+func replicate(writes []replicated_write) {
+	rw.Lock()
+	defer rw.Unlock()
+	for _, vertex := range node.NodeIDs() {
+		if vertex == node.ID() {
+			continue
+		}
+		if _, ok := pending[vertex]; !ok {
+			pending[vertex] = make(map[int]replicated_write)
+		}
+	}
+	for _, w := range writes {
+		next_write_id++
+		for _, queue := range pending {
+			queue[next_write_id] = w
+		}
+	}
+}
+
+func init_replication_routine() {
+	go func() {
+		for {
+			time.Sleep(replication_interval)
+
+			rw.RLock()
+			batches := make(map[string]map[int]replicated_write)
+			for vertex, queue := range pending {
+				if len(queue) == 0 {
+					continue
+				}
+				batch := make(map[int]replicated_write)
+				for id, w := range queue {
+					batch[id] = w
+				}
+				batches[vertex] = batch
+			}
+			rw.RUnlock()
+
+			for vertex, batch := range batches {
+				writes := make([]any, 0, len(batch))
+				for _, w := range batch {
+					writes = append(writes, w.to_array())
+				}
+				var body map[string]any = make(map[string]any)
+				body["type"] = "replicate"
+				body["writes"] = writes
+				node.RPC(vertex, body, func(msg maelstrom.Message) error {
+					// error replies land here too, only a replicate_ok means the peer applied the batch
+					if msg.RPCError() != nil || msg.Type() != "replicate_ok" {
+						return nil
+					}
+					rw.Lock()
+					defer rw.Unlock()
+					for id := range batch {
+						delete(pending[vertex], id)
+					}
+					return nil
+				})
+			}
+		}
+	}()
+}
+
+/*
+------------------
+   RPC Handlers
+------------------
+*/
+
+func handle_txn(msg maelstrom.Message) error {
+	body, err := get_body_from_msg(msg)
+	if err != nil {
+		return err
+	}
+
+	ops, err := generate_op_list(body["txn"].(any))
+	if err != nil {
+		return err
+	}
+	var ts timestamp
+	// final value, ttl and key of every written key
+	final := make(map[string]any)
+	ttls := make(map[string]int64)
+	written := make(map[string]any)
+
+	if isolation == read_uncommitted {
+		ts = now()
+		for i := range ops {
+			op := &ops[i]
+			rw.Lock()
+			if op.read {
+				op.val = read_entry(op.id).val
+			} else {
+				apply_write(op.id, op.val, ts, get_expiry(ts, op.ttl))
+				final[op.id] = op.val
+				ttls[op.id] = op.ttl
+				written[op.id] = op.key
+			}
+			rw.Unlock()
+		}
+	} else {
+		for i := range ops {
+			op := &ops[i]
+			if op.write {
+				final[op.id] = op.val
+				ttls[op.id] = op.ttl
+				written[op.id] = op.key
+				continue
+			}
+			if val, ok := final[op.id]; ok {
+				op.val = val
+				continue
+			}
+			rw.RLock()
+			current := read_entry(op.id)
+			rw.RUnlock()
+			observe(current.ts)
+			op.val = current.val
+		}
+
+		ts = now()
+		rw.Lock()
+		for id, val := range final {
+			apply_write(id, val, ts, get_expiry(ts, ttls[id]))
+		}
+		rw.Unlock()
+	}
+
+	body["type"] = "txn_ok"
+	resp := make([]any, 0)
+	for _, op := range ops {
+		resp = append(resp, op.to_array())
+	}
+	body["txn"] = resp
+	node.Reply(msg, body)
+
+	writes := make([]replicated_write, 0, len(final))
+	for id, val := range final {
+		writes = append(writes, replicated_write{written[id], val, ts, get_expiry(ts, ttls[id])})
+	}
+	replicate(writes)
+
+	return nil
+}
+
+func handle_replicate(msg maelstrom.Message) error {
+	body, err := get_body_from_msg(msg)
+	if err != nil {
+		return err
+	}
+
+	rw.Lock()
+	for _, raw := range body["writes"].([]any) {
+		item := raw.([]any)
+		ts := get_timestamp_from_body(item[2])
+		observe(ts)
+		id, err := encode_key(item[0])
+		if err != nil {
+			continue
+		}
+		apply_write(id, item[1], ts, int64(item[3].(float64)))
+	}
+	rw.Unlock()
+
+	var reply map[string]any = make(map[string]any)
+	reply["type"] = "replicate_ok"
+	return node.Reply(msg, reply)
+}
+
+func main() {
+	node = maelstrom.NewNode()
+	if value, ok := os.LookupEnv("KV_ISOLATION"); ok {
+		if value != read_uncommitted && value != read_committed {
+			log.Fatalf("unknown isolation level %s", value)
+		}
+		isolation = value
+	}
+	node.Handle("txn", handle_txn)
+	node.Handle("replicate", handle_replicate)
+	init_replication_routine()
+	init_sweep_routine()
+	err := node.Run()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
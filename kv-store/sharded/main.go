@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+/*
+
+Strategy:
+
+The keyspace is split into one shard per node by a hash of the encoded key, each node
+stores its shard (see participant.go). Any node coordinates the txns clients send it.
+
+Txn Handler (coordinator):
+
+- Split the ops by shard, keeping their order
+- A txn on one shard is sent as a one-phase prepare, which locks, executes and installs at once
+- Otherwise send prepare to every shard, each locks its keys and executes its ops
+- If every shard prepared, decide commit, else decide abort
+- Ack the txn with the read results, or fail it with txn-conflict on abort
+- Send the decision to every shard, which installs the writes and releases the locks
+
+Decision record:
+
+The decision on a txn is the value of txn_<id> in lin-kv, set by a compare-and-swap
+that creates the key. Only the first decision is ever written, later ones read it.
+A coordinator that crashes before deciding leaves its prepared txns in doubt, the
+shards time out and decide abort. If it crashed after deciding, they find its decision.
+
+Strict serializability:
+
+Every shard holds the locks of a txn from prepare until the decision, so committed txns
+are serializable by strict two-phase locking. The client is acked only once the decision
+is recorded, and a later txn can't read a key of the txn before the shard installs it
+because the key stays locked until then, so the order respects real time.
+
+State is kept in memory only, a crashed node loses its shard.
+
+*/
+
+// GLOBALS
+var node *maelstrom.Node
+var linKV maelstrom.KV
+
+const rpc_timeout = 1 * time.Second
+const retry_interval = 200 * time.Millisecond
+
+const commit string = "commit"
+const abort string = "abort"
+
+var txn_mu sync.Mutex
+var next_txn_id int = 0
+
+/*
+-----------
+   Utils
+-----------
+*/
+
+func get_body_from_msg(msg maelstrom.Message) (map[string]any, error) {
+	var body map[string]any
+	err := json.Unmarshal(msg.Body, &body)
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+/*
+Micro-ops of the txn-rw-register workload
+
+	["r", key, nil]  read
+	["w", key, val]  write
+*/
+type operation struct {
+	read  bool
+	write bool
+	key   any    // any json scalar
+	id    string // json encoding of key, 1 and "1" are different keys
+	val   any
+}
+
+func encode_key(key any) (string, error) {
+	switch key.(type) {
+	case string, float64, bool, nil:
+	default:
+		return "", maelstrom.NewRPCError(maelstrom.MalformedRequest, "keys must be json scalars")
+	}
+	buf, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func generate_op_list(input any) ([]operation, error) {
+	var ops []operation = make([]operation, 0)
+	for _, val := range input.([]any) {
+		item := val.([]any)
+		var op operation
+		id, err := encode_key(item[1])
+		if err != nil {
+			return nil, err
+		}
+		op.key = item[1]
+		op.id = id
+		op.val = item[2]
+		switch item[0].(string) {
+		case "r":
+			op.read = true
+		case "w":
+			op.write = true
+		default:
+			// only the txn-rw-register micro-ops, append is rejected too
+			return nil, maelstrom.NewRPCError(maelstrom.NotSupported, "unsupported micro-op "+item[0].(string))
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+func (op *operation) to_array() []any {
+	var array []any = make([]any, 0)
+	if op.read {
+		array = append(array, "r")
+	} else {
+		array = append(array, "w")
+	}
+	array = append(array, op.key)
+	array = append(array, op.val)
+	return array
+}
+
+func to_arrays(ops []operation) []any {
+	arrays := make([]any, 0, len(ops))
+	for _, op := range ops {
+		arrays = append(arrays, op.to_array())
+	}
+	return arrays
+}
+
+// node that stores the shard of an encoded key
+func get_shard(key string) string {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	ids := node.NodeIDs()
+	return ids[h.Sum32()%uint32(len(ids))]
+}
+
+/*
+------------------------
+   Decision Record
+------------------------
+*/
+
+/*
+Records want as the decision on txn id unless there is one already.
+Returns the decision that holds, which is want or what was decided first.
+*/
+func decide(ctx context.Context, id string, want string) (string, error) {
+	key := "txn_" + id
+	err := linKV.CompareAndSwap(ctx, key, want, want, true)
+	if err == nil {
+		return want, nil
+	}
+	if rpc_err, ok := err.(*maelstrom.RPCError); !ok || rpc_err.Code != maelstrom.PreconditionFailed {
+		return "", err
+	}
+	decision, err := linKV.Read(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	return decision.(string), nil
+}
+
+/*
+-----------------
+   Coordinator
+-----------------
+*/
+
+// sends a prepare for ops to shard, the results are returned in place
+func send_prepare(shard string, id string, ops []operation, one_phase bool) error {
+	if shard == node.ID() {
+		return prepare(id, ops, one_phase)
+	}
+
+	var body map[string]any = make(map[string]any)
+	body["type"] = "prepare"
+	body["txn_id"] = id
+	body["txn"] = to_arrays(ops)
+	body["one_phase"] = one_phase
+	ctx, cancel := context.WithTimeout(context.Background(), rpc_timeout)
+	defer cancel()
+	resp, err := node.SyncRPC(ctx, shard, body)
+	if err != nil {
+		return err
+	}
+	reply, err := get_body_from_msg(resp)
+	if err != nil {
+		return err
+	}
+	for i, raw := range reply["txn"].([]any) {
+		ops[i].val = raw.([]any)[2]
+	}
+	return nil
+}
+
+// sends the decision on txn id to shard until it acks
+func send_decision(shard string, id string, decision string) {
+	if shard == node.ID() {
+		finish(id, decision == commit)
+		return
+	}
+
+	var body map[string]any = make(map[string]any)
+	body["type"] = decision
+	body["txn_id"] = id
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), rpc_timeout)
+		_, err := node.SyncRPC(ctx, shard, body)
+		cancel()
+		if err == nil {
+			return
+		}
+		time.Sleep(retry_interval)
+	}
+}
+
+func handle_txn(msg maelstrom.Message) error {
+	body, err := get_body_from_msg(msg)
+	if err != nil {
+		return err
+	}
+
+	ops, err := generate_op_list(body["txn"].(any))
+	if err != nil {
+		return err
+	}
+
+	txn_mu.Lock()
+	next_txn_id++
+	id := fmt.Sprintf("%s-%d", node.ID(), next_txn_id)
+	txn_mu.Unlock()
+
+	// ops of every shard in txn order, with their index in the txn
+	shard_ops := make(map[string][]operation)
+	indexes := make(map[string][]int)
+	for i, op := range ops {
+		shard := get_shard(op.id)
+		shard_ops[shard] = append(shard_ops[shard], op)
+		indexes[shard] = append(indexes[shard], i)
+	}
+
+	if len(shard_ops) == 1 {
+		for shard, list := range shard_ops {
+			err = send_prepare(shard, id, list, true)
+			if err != nil {
+				if _, ok := err.(*maelstrom.RPCError); ok {
+					return err
+				}
+				// the shard may have executed it
+				return maelstrom.NewRPCError(maelstrom.Crash, "shard did not reply in time")
+			}
+			ops = list
+		}
+		return reply_txn(msg, body, ops)
+	}
+
+	var wg sync.WaitGroup
+	var prepare_mu sync.Mutex
+	prepared_all := true
+	for shard, list := range shard_ops {
+		wg.Add(1)
+		go func(shard string, list []operation) {
+			defer wg.Done()
+			err := send_prepare(shard, id, list, false)
+			if err != nil {
+				prepare_mu.Lock()
+				prepared_all = false
+				prepare_mu.Unlock()
+			}
+		}(shard, list)
+	}
+	wg.Wait()
+
+	want := commit
+	if !prepared_all {
+		want = abort
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), rpc_timeout)
+	decision, err := decide(ctx, id, want)
+	cancel()
+	if err != nil {
+		// shards in doubt resolve the txn themselves
+		return maelstrom.NewRPCError(maelstrom.Crash, "could not record the txn decision")
+	}
+
+	for shard := range shard_ops {
+		go send_decision(shard, id, decision)
+	}
+	if decision == abort {
+		return maelstrom.NewRPCError(maelstrom.TxnConflict, "txn aborted, a shard could not prepare")
+	}
+
+	for shard, list := range shard_ops {
+		for i, op := range list {
+			ops[indexes[shard][i]] = op
+		}
+	}
+	return reply_txn(msg, body, ops)
+}
+
+func reply_txn(msg maelstrom.Message, body map[string]any, ops []operation) error {
+	body["type"] = "txn_ok"
+	body["txn"] = to_arrays(ops)
+	return node.Reply(msg, body)
+}
+
+func main() {
+	node = maelstrom.NewNode()
+	linKV = *maelstrom.NewLinKV(node)
+	node.Handle("txn", handle_txn)
+	node.Handle("prepare", handle_prepare)
+	node.Handle("commit", handle_decision)
+	node.Handle("abort", handle_decision)
+	init_resolve_routine()
+	err := node.Run()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+/*
+----- Participant -----
+
+Every node stores the keys of its shard and takes part in the txns that touch them.
+
+Prepare takes the locks of the txn's keys on this shard, read locks for keys it only
+reads and write locks for keys it writes, then executes its ops in order with the
+writes buffered. Locks are no-wait: if one is held by another txn, prepare fails with
+txn-conflict and the txn aborts, so txns never wait on each other and can't deadlock.
+A prepared txn keeps its locks until it learns the decision.
+
+A participant that holds a prepared txn for in_doubt_timeout without hearing the
+decision resolves it on its own through the decision record (see decide), it either
+writes abort first or finds the coordinator's decision.
+*/
+
+const in_doubt_timeout = 2 * time.Second
+const resolve_interval = 500 * time.Millisecond
+
+type key_lock struct {
+	readers map[string]bool // txn ids
+	writer  string          // txn id, "" if not write locked
+}
+
+type prepared_txn struct {
+	id     string
+	reads  map[string]bool
+	writes map[string]any // encoded key -> final value
+	at     time.Time
+}
+
+// guarded by mu
+var mu sync.Mutex
+var kv map[string]any = make(map[string]any)
+var locks map[string]*key_lock = make(map[string]*key_lock)
+var prepared map[string]*prepared_txn = make(map[string]*prepared_txn)
+
+func get_lock(key string) *key_lock {
+	lock, ok := locks[key]
+	if !ok {
+		lock = &key_lock{make(map[string]bool), ""}
+		locks[key] = lock
+	}
+	return lock
+}
+
+// takes every lock of t or none of them, must be called with mu held
+func try_lock(t *prepared_txn) bool {
+	for key := range t.reads {
+		if lock, ok := locks[key]; ok && lock.writer != "" && lock.writer != t.id {
+			return false
+		}
+	}
+	for key := range t.writes {
+		lock, ok := locks[key]
+		if !ok {
+			continue
+		}
+		if lock.writer != "" && lock.writer != t.id {
+			return false
+		}
+		for reader := range lock.readers {
+			if reader != t.id {
+				return false
+			}
+		}
+	}
+	for key := range t.reads {
+		get_lock(key).readers[t.id] = true
+	}
+	for key := range t.writes {
+		get_lock(key).writer = t.id
+	}
+	return true
+}
+
+// must be called with mu held
+func unlock(t *prepared_txn) {
+	for key := range t.reads {
+		delete(locks[key].readers, t.id)
+	}
+	for key := range t.writes {
+		locks[key].writer = ""
+	}
+	for key := range t.reads {
+		release_if_free(key)
+	}
+	for key := range t.writes {
+		release_if_free(key)
+	}
+}
+
+func release_if_free(key string) {
+	if lock, ok := locks[key]; ok && lock.writer == "" && len(lock.readers) == 0 {
+		delete(locks, key)
+	}
+}
+
+/*
+Locks and executes ops of txn id on this shard, the results are returned in place.
+With one_phase the txn touches no other shard, its writes are installed right away.
+*/
+func prepare(id string, ops []operation, one_phase bool) error {
+	t := &prepared_txn{id, make(map[string]bool), make(map[string]any), time.Now()}
+	for _, op := range ops {
+		if op.write {
+			t.writes[op.id] = nil
+		}
+	}
+	for _, op := range ops {
+		if _, ok := t.writes[op.id]; op.read && !ok {
+			t.reads[op.id] = true
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !try_lock(t) {
+		return maelstrom.NewRPCError(maelstrom.TxnConflict, "a key is locked by a concurrent txn")
+	}
+
+	buffered := make(map[string]any)
+	for i := range ops {
+		op := &ops[i]
+		if op.write {
+			buffered[op.id] = op.val
+		} else if val, ok := buffered[op.id]; ok {
+			op.val = val
+		} else {
+			op.val = kv[op.id]
+		}
+	}
+	t.writes = buffered
+
+	if one_phase {
+		apply(t)
+		unlock(t)
+		return nil
+	}
+	prepared[id] = t
+	return nil
+}
+
+// must be called with mu held
+func apply(t *prepared_txn) {
+	for key, val := range t.writes {
+		kv[key] = val
+	}
+}
+
+// applies the decision on txn id, a txn that isn't prepared here was already finished
+func finish(id string, commit bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	t, ok := prepared[id]
+	if !ok {
+		return
+	}
+	if commit {
+		apply(t)
+	}
+	unlock(t)
+	delete(prepared, id)
+}
+
+func resolve_in_doubt() {
+	mu.Lock()
+	ids := make([]string, 0)
+	for id, t := range prepared {
+		if time.Since(t.at) >= in_doubt_timeout {
+			ids = append(ids, id)
+		}
+	}
+	mu.Unlock()
+
+	for _, id := range ids {
+		ctx, cancel := context.WithTimeout(context.Background(), rpc_timeout)
+		decision, err := decide(ctx, id, abort)
+		cancel()
+		if err != nil {
+			log.Printf("ERROR resolving txn %s: %s", id, err)
+			continue
+		}
+		finish(id, decision == commit)
+	}
+}
+
+func init_resolve_routine() {
+	go func() {
+		for {
+			time.Sleep(resolve_interval)
+			resolve_in_doubt()
+		}
+	}()
+}
+
+/*
+------------------
+   RPC Handlers
+------------------
+*/
+
+func handle_prepare(msg maelstrom.Message) error {
+	body, err := get_body_from_msg(msg)
+	if err != nil {
+		return err
+	}
+
+	ops, err := generate_op_list(body["txn"])
+	if err != nil {
+		return err
+	}
+	one_phase, _ := body["one_phase"].(bool)
+	err = prepare(body["txn_id"].(string), ops, one_phase)
+	if err != nil {
+		return err
+	}
+
+	var reply map[string]any = make(map[string]any)
+	reply["type"] = "prepare_ok"
+	reply["txn"] = to_arrays(ops)
+	return node.Reply(msg, reply)
+}
+
+func handle_decision(msg maelstrom.Message) error {
+	body, err := get_body_from_msg(msg)
+	if err != nil {
+		return err
+	}
+
+	finish(body["txn_id"].(string), body["type"] == commit)
+
+	var reply map[string]any = make(map[string]any)
+	reply["type"] = body["type"].(string) + "_ok"
+	return node.Reply(msg, reply)
+}
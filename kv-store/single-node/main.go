@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"log"
+	"os"
 	"sync"
 
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
@@ -12,7 +13,50 @@ import (
 var node *maelstrom.Node
 
 var rw sync.RWMutex
-var kv map[float64]float64 = make(map[float64]float64)
+
+/*
+Isolation level, set by KV_ISOLATION
+
+	serializable - strict two-phase locking (default)
+	snapshot     - snapshot isolation on the multi version store
+	optimistic   - serializable, reads are validated at commit instead of locked
+*/
+const serializable string = "serializable"
+const snapshot string = "snapshot"
+const optimistic string = "optimistic"
+
+var isolation string = serializable
+
+/*
+----- Locking -----
+Strict two-phase locking.
+A txn knows every key it touches up front, so it takes all of its locks at once
+before executing and releases them only after it is done.
+Locks are granted all-or-nothing while holding lock_mu,
+a waiting txn never holds a lock, so there are no deadlocks.
+
+A scan takes a shared lock on its whole key range, a write to a key inside a locked
+range waits for it, and a scan waits for writers of keys in its range. This keeps
+keys from appearing in a range a running txn has scanned (phantoms).
+*/
+
+type key_lock struct {
+	key     any
+	readers int
+	writer  bool
+}
+
+// keys are by encoded key, writes map to the raw key for range checks
+type lock_set struct {
+	reads  map[string]bool
+	writes map[string]any
+	ranges []*key_range
+}
+
+var lock_mu sync.Mutex
+var lock_cond *sync.Cond = sync.NewCond(&lock_mu)
+var locks map[string]*key_lock = make(map[string]*key_lock)
+var range_locks map[*key_range]bool = make(map[*key_range]bool)
 
 /*
 -----------
@@ -29,36 +73,110 @@ func get_body_from_msg(msg maelstrom.Message) (map[string]any, error) {
 	return body, nil
 }
 
+/*
+Micro-ops of the txn-rw-register and txn-list-append workloads
+
+	["r", key, nil]       read, a key used with append reads as the whole list
+	["w", key, val]       write, a TTL as a fourth element is only supported by the multi-node store
+	["append", key, val]  append val to the list stored at key
+	["scan", range, nil]  keys in range with their values as [[key, val], ...] in key order,
+	                      range is {"start": key, "end": key, "limit": n} and every field is optional,
+	                      start is inclusive and end exclusive
+*/
 type operation struct {
-	read  bool
-	write bool
-	key   float64
-	val   float64
+	read   bool
+	write  bool
+	append bool
+	scan   bool
+	key    any    // any json scalar, or the range object of a scan
+	id     string // json encoding of key, 1 and "1" are different keys
+	r      *key_range
+	val    any
 }
 
-func generate_op_list(input any) []operation {
+func encode_key(key any) (string, error) {
+	switch key.(type) {
+	case string, float64, bool, nil:
+	default:
+		return "", maelstrom.NewRPCError(maelstrom.MalformedRequest, "keys must be json scalars")
+	}
+	buf, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func get_range_from_body(raw any) (*key_range, error) {
+	err := maelstrom.NewRPCError(maelstrom.MalformedRequest, "scan range must be an object of json scalar bounds")
+	body, ok := raw.(map[string]any)
+	if !ok {
+		return nil, err
+	}
+	r := &key_range{}
+	r.start, r.has_start = body["start"]
+	r.end, r.has_end = body["end"]
+	if _, e := encode_key(r.start); e != nil {
+		return nil, err
+	}
+	if _, e := encode_key(r.end); e != nil {
+		return nil, err
+	}
+	if limit, ok := body["limit"].(float64); ok {
+		r.limit = int(limit)
+	}
+	return r, nil
+}
+
+func generate_op_list(input any) ([]operation, error) {
 	var ops []operation = make([]operation, 0)
 	for _, val := range input.([]any) {
 		item := val.([]any)
 		var op operation
-		op.key = item[1].(float64)
-		if item[2] != nil {
-			op.val = item[2].(float64)
+		if item[0].(string) == "scan" {
+			r, err := get_range_from_body(item[1])
+			if err != nil {
+				return nil, err
+			}
+			op.scan = true
+			op.key = item[1]
+			op.r = r
+			ops = append(ops, op)
+			continue
+		}
+		id, err := encode_key(item[1])
+		if err != nil {
+			return nil, err
 		}
-		if item[0].(string) == "r" {
+		op.key = item[1]
+		op.id = id
+		op.val = item[2]
+		switch item[0].(string) {
+		case "r":
 			op.read = true
-		} else {
+		case "w":
+			if len(item) > 3 {
+				return nil, maelstrom.NewRPCError(maelstrom.NotSupported, "writes with a ttl are not supported")
+			}
 			op.write = true
+		case "append":
+			op.append = true
+		default:
+			return nil, maelstrom.NewRPCError(maelstrom.MalformedRequest, "unknown micro-op "+item[0].(string))
 		}
 		ops = append(ops, op)
 	}
-	return ops
+	return ops, nil
 }
 
 func (op *operation) to_array() []any {
 	var array []any = make([]any, 0)
 	if op.read {
 		array = append(array, "r")
+	} else if op.append {
+		array = append(array, "append")
+	} else if op.scan {
+		array = append(array, "scan")
 	} else {
 		array = append(array, "w")
 	}
@@ -67,6 +185,131 @@ func (op *operation) to_array() []any {
 	return array
 }
 
+// keys read and written and ranges scanned by ops, a key that is written is only in writes
+func get_lock_set(ops []operation) *lock_set {
+	set := &lock_set{make(map[string]bool), make(map[string]any), nil}
+	for _, op := range ops {
+		if op.write || op.append {
+			set.writes[op.id] = op.key
+		}
+	}
+	for _, op := range ops {
+		if op.read {
+			if _, ok := set.writes[op.id]; !ok {
+				set.reads[op.id] = true
+			}
+		}
+		if op.scan {
+			set.ranges = append(set.ranges, op.r)
+		}
+	}
+	return set
+}
+
+// must be called with lock_mu held
+func can_grant(set *lock_set) bool {
+	for key := range set.reads {
+		if lock, ok := locks[key]; ok && lock.writer {
+			return false
+		}
+	}
+	for key, raw := range set.writes {
+		if lock, ok := locks[key]; ok && (lock.writer || lock.readers > 0) {
+			return false
+		}
+		for r := range range_locks {
+			if r.contains(raw) {
+				return false
+			}
+		}
+	}
+	for _, r := range set.ranges {
+		for _, lock := range locks {
+			if lock.writer && r.contains(lock.key) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func get_lock(key string, raw any) *key_lock {
+	lock, ok := locks[key]
+	if !ok {
+		lock = &key_lock{key: raw}
+		locks[key] = lock
+	}
+	return lock
+}
+
+func acquire_locks(set *lock_set) {
+	lock_mu.Lock()
+	defer lock_mu.Unlock()
+	for !can_grant(set) {
+		lock_cond.Wait()
+	}
+	for key := range set.reads {
+		get_lock(key, nil).readers++
+	}
+	for key, raw := range set.writes {
+		get_lock(key, raw).writer = true
+	}
+	for _, r := range set.ranges {
+		range_locks[r] = true
+	}
+}
+
+func release_locks(set *lock_set) {
+	lock_mu.Lock()
+	defer lock_mu.Unlock()
+	for key := range set.reads {
+		locks[key].readers--
+	}
+	for key := range set.writes {
+		locks[key].writer = false
+	}
+	for _, r := range set.ranges {
+		delete(range_locks, r)
+	}
+	for key, lock := range locks {
+		if lock.readers == 0 && !lock.writer {
+			delete(locks, key)
+		}
+	}
+	lock_cond.Broadcast()
+}
+
+// runs ops as one txn at the isolation level of the node, read results are set in place
+func execute_txn(ops []operation) error {
+	// under 2PL the txn runs in isolation while holding its locks,
+	// under snapshot isolation it reads its snapshot and conflicts are found at commit,
+	// an optimistic txn runs without locks and its reads are validated at commit
+	if isolation == serializable {
+		set := get_lock_set(ops)
+		acquire_locks(set)
+		defer release_locks(set)
+	}
+
+	t := begin_txn(isolation)
+	for i := range ops {
+		op := &ops[i]
+		if op.read {
+			op.val = t.read(op.id)
+		} else if op.append {
+			err := t.append(op.id, op.val)
+			if err != nil {
+				t.abort()
+				return err
+			}
+		} else if op.scan {
+			op.val = t.scan(op.r)
+		} else {
+			t.write(op.id, op.val)
+		}
+	}
+	return t.commit()
+}
+
 /*
 ------------------
    RPC Handlers
@@ -80,17 +323,13 @@ func handle_txn(msg maelstrom.Message) error {
 		return err
 	}
 
-	var ops []operation = generate_op_list(body["txn"].(any))
-	for _, op := range ops {
-		if op.read {
-			rw.RLock()
-			op.val = kv[op.key]
-			rw.RUnlock()
-		} else {
-			rw.Lock()
-			kv[op.key] = op.val
-			rw.Unlock()
-		}
+	ops, err := generate_op_list(body["txn"].(any))
+	if err != nil {
+		return err
+	}
+	err = execute_txn(ops)
+	if err != nil {
+		return err
 	}
 
 	body["type"] = "txn_ok"
@@ -106,7 +345,30 @@ func handle_txn(msg maelstrom.Message) error {
 
 func main() {
 	node = maelstrom.NewNode()
+	if value, ok := os.LookupEnv("KV_ISOLATION"); ok {
+		if value != serializable && value != snapshot && value != optimistic {
+			log.Fatalf("unknown isolation level %s", value)
+		}
+		isolation = value
+	}
+	data_dir = os.Getenv("KV_DATA_DIR")
+	if value, ok := os.LookupEnv("KV_FSYNC"); ok {
+		if value != fsync_always && value != fsync_batch && value != fsync_none {
+			log.Fatalf("unknown fsync policy %s", value)
+		}
+		fsync_policy = value
+	}
+	node.Handle("init", func(msg maelstrom.Message) error {
+		if data_dir == "" {
+			return nil
+		}
+		return recover_store()
+	})
 	node.Handle("txn", handle_txn)
+	node.Handle("watch", handle_watch)
+	node.Handle("unwatch", handle_unwatch)
+	init_gc_routine()
+	init_publish_routine()
 	err := node.Run()
 	if err != nil {
 		log.Fatal(err)
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+/*
+----- Multi Version Store -----
+
+Every key keeps a list of versions ordered by commit timestamp,
+keys live in the ordered store (see skiplist.go).
+A commit timestamp is taken from clock, which counts committed txns.
+
+A txn reads as of its start timestamp and buffers its writes,
+all writes of a txn are installed at once with a single commit timestamp.
+
+Snapshot isolation: a txn starts at the latest commit timestamp and reads that snapshot.
+At commit, if any key it writes got a version newer than its start, another txn
+committed first and this txn aborts with txn-conflict (first-committer-wins).
+
+Optimistic: a txn reads the latest committed versions without taking locks and
+remembers the version of every key it read. At commit, if any of those keys got a
+newer version, the txn aborts with txn-conflict and the client can retry.
+Validation and install happen under rw, so committed txns are serializable.
+Scans are validated too: the committed versions in a scanned range must be the same
+at commit as when the txn scanned it, so a key inserted into the range is caught.
+
+Versions that no running snapshot can see are garbage collected.
+*/
+
+// val is any json value for registers and a []any for lists, versions are keyed by encoded key
+type version struct {
+	ts  int
+	val any
+}
+
+// guarded by rw
+var store *skiplist = new_skiplist()
+var clock int = 0
+
+// start timestamp -> number of running snapshot txns
+var active map[int]int = make(map[int]int)
+
+// start timestamp of 2PL txns, locks make the latest version its snapshot
+const latest int = math.MaxInt
+
+const gc_interval = 1 * time.Second
+
+type txn struct {
+	start      int
+	snapshot   bool
+	optimistic bool
+	writes     map[string]any
+	reads      map[string]int // key -> ts of the version read, 0 if it didn't exist
+	scans      []scan_record
+}
+
+// a key in the result of a scan
+type scan_entry struct {
+	key any
+	id  string
+	val any
+	ts  int
+}
+
+// committed versions an optimistic txn saw in a scanned range
+type scan_record struct {
+	r       *key_range
+	entries []scan_entry
+}
+
+func begin_txn(level string) *txn {
+	t := &txn{latest, level == snapshot, level == optimistic, make(map[string]any), make(map[string]int), nil}
+	if t.snapshot {
+		rw.Lock()
+		t.start = clock
+		active[t.start]++
+		rw.Unlock()
+	}
+	return t
+}
+
+func decode_key(id string) any {
+	var key any
+	json.Unmarshal([]byte(id), &key)
+	return key
+}
+
+// latest version of key with ts <= at, must be called with rw held
+func read_at(key string, at int) (version, bool) {
+	n := store.get(key)
+	if n == nil {
+		return version{}, false
+	}
+	return get_visible(n.versions, at)
+}
+
+func get_visible(list []version, at int) (version, bool) {
+	for i := len(list) - 1; i >= 0; i-- {
+		if list[i].ts <= at {
+			return list[i], true
+		}
+	}
+	return version{}, false
+}
+
+// returns nil if key doesn't exist
+func (t *txn) read(key string) any {
+	if val, ok := t.writes[key]; ok {
+		return val
+	}
+	rw.RLock()
+	defer rw.RUnlock()
+	v, _ := read_at(key, t.start)
+	if _, ok := t.reads[key]; !ok {
+		t.reads[key] = v.ts
+	}
+	return v.val
+}
+
+// ts of the newest version of key, 0 if it doesn't exist. must be called with rw held
+func newest_ts(key string) int {
+	n := store.get(key)
+	if n == nil || len(n.versions) == 0 {
+		return 0
+	}
+	return n.versions[len(n.versions)-1].ts
+}
+
+// committed keys in r as of at, in key order. must be called with rw held
+func scan_at(r *key_range, at int) []scan_entry {
+	entries := make([]scan_entry, 0)
+	for n := store.first(r); n != nil && r.contains(n.key); n = n.next[0] {
+		v, ok := get_visible(n.versions, at)
+		if ok {
+			entries = append(entries, scan_entry{n.key, n.id, v.val, v.ts})
+		}
+	}
+	return entries
+}
+
+// keys in r with their values as [[key, val], ...], in key order and including the txn's own writes
+func (t *txn) scan(r *key_range) []any {
+	rw.RLock()
+	committed := scan_at(r, t.start)
+	rw.RUnlock()
+	if t.optimistic {
+		t.scans = append(t.scans, scan_record{r, committed})
+	}
+
+	merged := make(map[string]scan_entry)
+	for _, e := range committed {
+		merged[e.id] = e
+	}
+	for id, val := range t.writes {
+		key := decode_key(id)
+		if r.contains(key) {
+			merged[id] = scan_entry{key, id, val, 0}
+		}
+	}
+	entries := make([]scan_entry, 0, len(merged))
+	for _, e := range merged {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return compare_keys(entries[i].key, entries[j].key) < 0
+	})
+	if r.limit > 0 && len(entries) > r.limit {
+		entries = entries[:r.limit]
+	}
+
+	result := make([]any, 0, len(entries))
+	for _, e := range entries {
+		result = append(result, []any{e.key, e.val})
+	}
+	return result
+}
+
+func same_entries(a []scan_entry, b []scan_entry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].id != b[i].id || a[i].ts != b[i].ts {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *txn) write(key string, val any) {
+	t.writes[key] = val
+}
+
+// lists are copied on append, versions never share a backing array. fails if key holds a value that isn't a list
+func (t *txn) append(key string, val any) error {
+	current := t.read(key)
+	list, ok := current.([]any)
+	if !ok && current != nil {
+		return maelstrom.NewRPCError(maelstrom.PreconditionFailed, "can't append to "+key+", it doesn't hold a list")
+	}
+	next := make([]any, len(list), len(list)+1)
+	copy(next, list)
+	t.writes[key] = append(next, val)
+	return nil
+}
+
+// installs the writes of t, returns a txn-conflict error if a snapshot txn lost a write-write race.
+// returns once the commit is as durable as the fsync policy asks for
+func (t *txn) commit() error {
+	offset, err := t.install()
+	if err != nil {
+		return err
+	}
+	return wait_durable(offset)
+}
+
+// returns the end offset of the commit record in the write-ahead log
+func (t *txn) install() (int64, error) {
+	rw.Lock()
+	defer rw.Unlock()
+	t.end()
+
+	if t.snapshot {
+		for key := range t.writes {
+			if newest_ts(key) > t.start {
+				return 0, maelstrom.NewRPCError(maelstrom.TxnConflict, "concurrent txn committed a write first")
+			}
+		}
+	}
+	if t.optimistic {
+		for key, ts := range t.reads {
+			if newest_ts(key) != ts {
+				return 0, maelstrom.NewRPCError(maelstrom.TxnConflict, "a key read by the txn was changed by a concurrent txn")
+			}
+		}
+		for _, record := range t.scans {
+			if !same_entries(record.entries, scan_at(record.r, latest)) {
+				return 0, maelstrom.NewRPCError(maelstrom.TxnConflict, "a range scanned by the txn was changed by a concurrent txn")
+			}
+		}
+	}
+
+	if len(t.writes) == 0 {
+		// a read-only txn may have read commits that aren't synced yet
+		return get_log_position(), nil
+	}
+	// logged before it becomes visible
+	offset, err := log_commit(clock+1, t.writes)
+	if err != nil {
+		return 0, err
+	}
+	clock++
+	for key, val := range t.writes {
+		n := store.get_or_insert(decode_key(key), key)
+		n.versions = append(n.versions, version{clock, val})
+	}
+	queue_change(clock, t.writes, offset)
+	return offset, nil
+}
+
+// ends t without installing its writes
+func (t *txn) abort() {
+	rw.Lock()
+	defer rw.Unlock()
+	t.end()
+}
+
+// removes t from the running snapshots, must be called with rw held
+func (t *txn) end() {
+	if !t.snapshot {
+		return
+	}
+	active[t.start]--
+	if active[t.start] == 0 {
+		delete(active, t.start)
+	}
+}
+
+// drops versions that are shadowed for every running snapshot
+func collect_garbage() {
+	rw.Lock()
+	defer rw.Unlock()
+
+	oldest := clock
+	for start := range active {
+		oldest = min(oldest, start)
+	}
+
+	for n := store.first(nil); n != nil; n = n.next[0] {
+		// newest version visible to the oldest snapshot, everything before it is unreachable
+		keep := 0
+		for i := range n.versions {
+			if n.versions[i].ts <= oldest {
+				keep = i
+			}
+		}
+		if keep > 0 {
+			n.versions = append([]version(nil), n.versions[keep:]...)
+		}
+	}
+}
+
+func init_gc_routine() {
+	go func() {
+		for {
+			time.Sleep(gc_interval)
+			collect_garbage()
+		}
+	}()
+}
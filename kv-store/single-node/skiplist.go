@@ -0,0 +1,163 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+)
+
+/*
+----- Ordered Key Storage -----
+
+Keys are kept in a skiplist ordered by compare_keys, which gives scans their order.
+Point lookups go through index, a hash map from encoded key to skiplist node.
+
+Keys of different json types are ordered null < booleans < numbers < strings.
+*/
+
+const max_level = 24
+
+type skiplist_node struct {
+	key      any    // raw json scalar
+	id       string // json encoding of key
+	versions []version
+	next     []*skiplist_node
+}
+
+type skiplist struct {
+	head  *skiplist_node
+	level int
+	index map[string]*skiplist_node
+}
+
+// bounds of a scan, start is inclusive and end exclusive. limit 0 means no limit
+type key_range struct {
+	start     any
+	has_start bool
+	end       any
+	has_end   bool
+	limit     int
+}
+
+func new_skiplist() *skiplist {
+	head := &skiplist_node{next: make([]*skiplist_node, max_level)}
+	return &skiplist{head, 1, make(map[string]*skiplist_node)}
+}
+
+func get_type_rank(key any) int {
+	switch key.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case float64:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// returns -1, 0 or 1 as a is before, equal to or after b
+func compare_keys(a any, b any) int {
+	rank_a, rank_b := get_type_rank(a), get_type_rank(b)
+	if rank_a != rank_b {
+		if rank_a < rank_b {
+			return -1
+		}
+		return 1
+	}
+	switch a := a.(type) {
+	case bool:
+		b := b.(bool)
+		if a == b {
+			return 0
+		} else if !a {
+			return -1
+		}
+		return 1
+	case float64:
+		b := b.(float64)
+		if a < b {
+			return -1
+		} else if a > b {
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(a, b.(string))
+	}
+	return 0
+}
+
+func (r *key_range) contains(key any) bool {
+	if r.has_start && compare_keys(key, r.start) < 0 {
+		return false
+	}
+	if r.has_end && compare_keys(key, r.end) >= 0 {
+		return false
+	}
+	return true
+}
+
+func random_level() int {
+	level := 1
+	for level < max_level && rand.Intn(4) == 0 {
+		level++
+	}
+	return level
+}
+
+func (l *skiplist) get(id string) *skiplist_node {
+	return l.index[id]
+}
+
+func (l *skiplist) get_or_insert(key any, id string) *skiplist_node {
+	if n, ok := l.index[id]; ok {
+		return n
+	}
+
+	update := make([]*skiplist_node, max_level)
+	x := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && compare_keys(x.next[i].key, key) < 0 {
+			x = x.next[i]
+		}
+		update[i] = x
+	}
+
+	level := random_level()
+	for i := l.level; i < level; i++ {
+		update[i] = l.head
+	}
+	l.level = max(l.level, level)
+
+	n := &skiplist_node{key, id, nil, make([]*skiplist_node, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = update[i].next[i]
+		update[i].next[i] = n
+	}
+	l.index[id] = n
+	return n
+}
+
+// first node with a key >= key
+func (l *skiplist) seek(key any) *skiplist_node {
+	x := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && compare_keys(x.next[i].key, key) < 0 {
+			x = x.next[i]
+		}
+	}
+	return x.next[0]
+}
+
+// first node of the range r, in key order
+func (l *skiplist) first(r *key_range) *skiplist_node {
+	if r != nil && r.has_start {
+		return l.seek(r.start)
+	}
+	return l.head.next[0]
+}
+
+func (l *skiplist) len() int {
+	return len(l.index)
+}
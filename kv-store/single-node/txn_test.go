@@ -0,0 +1,418 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+/*
+Concurrent txn-list-append histories at every isolation level, checked the way Elle does.
+
+Txns are built as micro-op lists and run through generate_op_list and execute_txn,
+the path of handle_txn. Every append writes a unique value, so the final list of a key
+is its version order and every read names the txn whose append it saw last.
+From that the checker infers the dependencies between committed txns
+
+	ww  T1 appended an element and T2 appended the next one of the same key
+	wr  T2 read a list whose last element T1 appended
+	rw  T1 read a list and T2 appended the element after it
+
+and looks for cycles: G0 through ww edges only, G1c through ww and wr edges,
+G2 through any edges. It also reports reads that aren't a prefix of the final list,
+elements of aborted txns (G1a) and reads of a txn's intermediate state (G1b).
+*/
+
+func TestMain(m *testing.M) {
+	node = maelstrom.NewNode()
+	node.Init("n1", []string{"n1"})
+	init_publish_routine()
+	os.Exit(m.Run())
+}
+
+func get_id(key any) string {
+	id, err := encode_key(key)
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+const dep_ww string = "ww"
+const dep_wr string = "wr"
+const dep_rw string = "rw"
+
+type history struct {
+	txns    [][]operation    // committed txns with their results
+	writer  map[float64]int  // appended value -> index of the committed txn
+	aborted map[float64]bool // values appended by txns that aborted
+	final   map[string][]any // encoded key -> list after all txns
+}
+
+type dependency struct {
+	from int
+	to   int
+	kind string
+}
+
+func new_history() *history {
+	return &history{nil, make(map[float64]int), make(map[float64]bool), make(map[string][]any)}
+}
+
+// adds a committed txn
+func (h *history) add(ops []operation) {
+	for _, op := range ops {
+		if op.append {
+			h.writer[op.val.(float64)] = len(h.txns)
+		}
+	}
+	h.txns = append(h.txns, ops)
+}
+
+// runs a txn given as micro-ops the way handle_txn does, returns the ops with their results
+func run_txn(input []any) ([]operation, error) {
+	ops, err := generate_op_list(input)
+	if err != nil {
+		return nil, err
+	}
+	return ops, execute_txn(ops)
+}
+
+func is_conflict(err error) bool {
+	var rpc_err *maelstrom.RPCError
+	return errors.As(err, &rpc_err) && rpc_err.Code == maelstrom.TxnConflict
+}
+
+/*
+Runs random txns of reads and appends from concurrent workers, then reads every key.
+Like Elle, txns use a few keys at a time and move on to fresh ones, so lists stay short.
+*/
+func record_history(t *testing.T, prefix string, workers int, count int) *history {
+	h := new_history()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(int64(w)))
+			for i := 0; i < count; i++ {
+				input := make([]any, 0)
+				for n := 1 + random.Intn(4); n > 0; n-- {
+					key := fmt.Sprintf("%s-%d", prefix, i/keys_per_window*keys_per_window+random.Intn(keys_per_window))
+					if random.Intn(2) == 0 {
+						input = append(input, []any{"r", key, nil})
+					} else {
+						value := float64(w*count + i)
+						input = append(input, []any{"append", key, value})
+					}
+				}
+
+				ops, err := run_txn(input)
+				mu.Lock()
+				if err == nil {
+					h.add(ops)
+				} else if is_conflict(err) {
+					for _, op := range ops {
+						if op.append {
+							h.aborted[op.val.(float64)] = true
+						}
+					}
+				} else {
+					t.Errorf("txn %v failed: %s", input, err)
+				}
+				mu.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	input := make([]any, 0)
+	for i := 0; i < count; i++ {
+		input = append(input, []any{"r", fmt.Sprintf("%s-%d", prefix, i), nil})
+	}
+	ops, err := run_txn(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range ops {
+		list, _ := op.val.([]any)
+		h.final[op.id] = list
+	}
+	return h
+}
+
+// ops with their results, as the client would see them
+func format_txn(ops []operation) []any {
+	result := make([]any, 0)
+	for _, op := range ops {
+		result = append(result, op.to_array())
+	}
+	return result
+}
+
+/*
+Infers the dependencies between the committed txns of h.
+Returns them and every anomaly that isn't a cycle.
+*/
+func (h *history) dependencies() ([]dependency, []string) {
+	deps := make([]dependency, 0)
+	anomalies := make([]string, 0)
+
+	for id, list := range h.final {
+		for i, raw := range list {
+			value := raw.(float64)
+			if h.aborted[value] {
+				anomalies = append(anomalies, fmt.Sprintf("G1a: %s holds %v of an aborted txn", id, value))
+			}
+			if i == 0 {
+				continue
+			}
+			from, to := h.writer[list[i-1].(float64)], h.writer[value]
+			if from != to {
+				deps = append(deps, dependency{from, to, dep_ww})
+			}
+		}
+	}
+
+	for index, ops := range h.txns {
+		own := make(map[float64]bool)
+		for _, op := range ops {
+			if op.append {
+				own[op.val.(float64)] = true
+			}
+		}
+		for _, op := range ops {
+			if !op.read {
+				continue
+			}
+			read, _ := op.val.([]any)
+			final := h.final[op.id]
+			if len(read) > len(final) || !equal_lists(read, final[:len(read)]) {
+				anomalies = append(anomalies, fmt.Sprintf("txn %v read %s as %v, not a prefix of the final %v",
+					format_txn(ops), op.id, read, final))
+				continue
+			}
+			// the txn's own appends come last, what it saw of other txns is before them
+			seen := len(read)
+			for seen > 0 && own[read[seen-1].(float64)] {
+				seen--
+			}
+			if seen > 0 {
+				from := h.writer[read[seen-1].(float64)]
+				deps = append(deps, dependency{from, index, dep_wr})
+				if seen < len(final) && h.writer[final[seen].(float64)] == from {
+					anomalies = append(anomalies, fmt.Sprintf("G1b: txn %v read %s before the last append of txn %v",
+						format_txn(ops), op.id, format_txn(h.txns[from])))
+				}
+			}
+			if seen < len(final) {
+				to := h.writer[final[seen].(float64)]
+				if to != index {
+					deps = append(deps, dependency{index, to, dep_rw})
+				}
+			}
+		}
+	}
+	return deps, anomalies
+}
+
+func equal_lists(a []any, b []any) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// a cycle of txns through edges of the given kinds, nil if there is none
+func find_cycle(count int, deps []dependency, kinds ...string) []int {
+	allowed := make(map[string]bool)
+	for _, kind := range kinds {
+		allowed[kind] = true
+	}
+	edges := make([][]int, count)
+	for _, dep := range deps {
+		if allowed[dep.kind] {
+			edges[dep.from] = append(edges[dep.from], dep.to)
+		}
+	}
+
+	// iterative dfs, a back edge to a txn on the stack closes a cycle
+	const unvisited, on_stack, done = 0, 1, 2
+	state := make([]int, count)
+	parent := make([]int, count)
+	for root := 0; root < count; root++ {
+		if state[root] != unvisited {
+			continue
+		}
+		stack := []int{root}
+		next_edge := make(map[int]int)
+		state[root] = on_stack
+		for len(stack) > 0 {
+			txn := stack[len(stack)-1]
+			if next_edge[txn] == len(edges[txn]) {
+				state[txn] = done
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			to := edges[txn][next_edge[txn]]
+			next_edge[txn]++
+			if state[to] == on_stack {
+				cycle := []int{to}
+				for at := txn; at != to; at = parent[at] {
+					cycle = append(cycle, at)
+				}
+				return cycle
+			}
+			if state[to] == unvisited {
+				state[to] = on_stack
+				parent[to] = txn
+				stack = append(stack, to)
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Checks h for the anomalies its isolation level forbids. Serializable levels forbid
+every cycle, snapshot isolation allows G2 (write skew) but no G0 or G1c.
+*/
+func check_history(t *testing.T, h *history, level string) {
+	t.Helper()
+	deps, anomalies := h.dependencies()
+	for _, anomaly := range anomalies {
+		t.Error(anomaly)
+	}
+
+	checks := []struct {
+		name  string
+		kinds []string
+	}{
+		{"G0", []string{dep_ww}},
+		{"G1c", []string{dep_ww, dep_wr}},
+	}
+	if level != snapshot {
+		checks = append(checks, struct {
+			name  string
+			kinds []string
+		}{"G2", []string{dep_ww, dep_wr, dep_rw}})
+	}
+	for _, check := range checks {
+		cycle := find_cycle(len(h.txns), deps, check.kinds...)
+		if cycle == nil {
+			continue
+		}
+		txns := make([]any, 0, len(cycle))
+		for _, index := range cycle {
+			txns = append(txns, format_txn(h.txns[index]))
+		}
+		t.Errorf("%s cycle between txns %v", check.name, txns)
+	}
+}
+
+const keys_per_window = 4
+
+func TestListAppendHistory(t *testing.T) {
+	const workers = 16
+	const txns = 1000
+
+	for _, level := range []string{serializable, snapshot, optimistic} {
+		t.Run(level, func(t *testing.T) {
+			isolation = level
+			h := record_history(t, level, workers, txns)
+			if len(h.txns) < workers*txns/4 {
+				t.Fatalf("only %d of %d txns committed", len(h.txns), workers*txns)
+			}
+			check_history(t, h, level)
+		})
+	}
+}
+
+// the checker itself finds the anomalies of hand written histories
+func TestCheckerFindsAnomalies(t *testing.T) {
+	read := func(key string, list ...any) operation {
+		return operation{read: true, key: key, id: get_id(key), val: list}
+	}
+	appended := func(key string, value float64) operation {
+		return operation{append: true, key: key, id: get_id(key), val: value}
+	}
+	final := func(h *history, key string, list ...any) {
+		h.final[get_id(key)] = list
+	}
+
+	// write skew: each txn read the other's key empty and appended to its own
+	h := new_history()
+	h.add([]operation{read("x"), appended("y", 1)})
+	h.add([]operation{read("y"), appended("x", 2)})
+	final(h, "x", float64(2))
+	final(h, "y", float64(1))
+	deps, anomalies := h.dependencies()
+	if len(anomalies) > 0 || find_cycle(2, deps, dep_ww, dep_wr) != nil {
+		t.Errorf("write skew reported as %v, %v", anomalies, deps)
+	}
+	if find_cycle(2, deps, dep_ww, dep_wr, dep_rw) == nil {
+		t.Errorf("write skew not found as a G2 cycle")
+	}
+
+	// each txn saw the other's append and not the other way around
+	h = new_history()
+	h.add([]operation{appended("x", 1), read("y", float64(2))})
+	h.add([]operation{appended("y", 2), read("x", float64(1))})
+	final(h, "x", float64(1))
+	final(h, "y", float64(2))
+	deps, _ = h.dependencies()
+	if find_cycle(2, deps, dep_ww, dep_wr) == nil {
+		t.Errorf("circular information flow not found as a G1c cycle")
+	}
+
+	// two txns appended to x and y in opposite orders
+	h = new_history()
+	h.add([]operation{appended("x", 1), appended("y", 2)})
+	h.add([]operation{appended("x", 3), appended("y", 4)})
+	final(h, "x", float64(1), float64(3))
+	final(h, "y", float64(4), float64(2))
+	deps, _ = h.dependencies()
+	if find_cycle(2, deps, dep_ww) == nil {
+		t.Errorf("dirty write not found as a G0 cycle")
+	}
+
+	// an aborted append became visible, and a read saw half of a txn
+	h = new_history()
+	h.aborted[5] = true
+	h.add([]operation{appended("x", 1), appended("x", 2)})
+	h.add([]operation{read("x", float64(1))})
+	final(h, "x", float64(1), float64(2), float64(5))
+	_, anomalies = h.dependencies()
+	if len(anomalies) != 2 {
+		t.Errorf("found %v, want a G1a and a G1b anomaly", anomalies)
+	}
+}
+
+// micro-ops the store can't run are rejected before the txn starts
+func TestRejectedMicroOps(t *testing.T) {
+	cases := []struct {
+		input []any
+		code  int
+	}{
+		{[]any{[]any{"inc", "x", float64(1)}}, maelstrom.MalformedRequest},
+		{[]any{[]any{"w", "x", float64(1), float64(1000)}}, maelstrom.NotSupported},
+	}
+	for _, c := range cases {
+		_, err := run_txn(c.input)
+		var rpc_err *maelstrom.RPCError
+		if !errors.As(err, &rpc_err) || rpc_err.Code != c.code {
+			t.Errorf("txn %v returned %v, want error code %d", c.input, err, c.code)
+		}
+	}
+}
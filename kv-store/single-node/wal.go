@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+/*
+----- Durability -----
+
+Enabled by setting KV_DATA_DIR, every node keeps its files in KV_DATA_DIR/<node id>.
+
+	wal.log        append-only log of committed txns
+	snapshot.json  latest version of every key as of a commit timestamp
+
+A WAL record is [length uint32][crc32 uint32][json payload], the payload holds the
+commit timestamp and the writes of one txn. A crash can leave a partially written
+record at the end of the log. Recovery stops at the first record that is short or
+fails its checksum and truncates the log there.
+
+Fsync policy, set by KV_FSYNC
+
+	always - fsync every commit before replying
+	batch  - commits wait for a group fsync, done every fsync_interval (default)
+	none   - leave flushing to the OS
+
+Under batch a commit is visible before it is synced, so a read-only txn waits for the
+log position at its commit too, it may have read a commit that isn't synced yet.
+A failed group fsync fails every waiting txn and the node stops serving txns,
+it can't tell which visible commits would survive a crash.
+
+Every snapshot_every records the latest versions are written to a new snapshot,
+which replaces the old one by rename, and the log is truncated.
+Records at or below the snapshot timestamp are skipped on replay,
+so a crash between the rename and the truncate is harmless.
+*/
+
+const fsync_always string = "always"
+const fsync_batch string = "batch"
+const fsync_none string = "none"
+
+const fsync_interval = 5 * time.Millisecond
+const snapshot_check_interval = 1 * time.Second
+const snapshot_every = 1000
+const wal_header_size = 8
+
+var data_dir string = ""
+var fsync_policy string = fsync_batch
+
+// guarded by wal_mu. written and synced count bytes ever logged, they don't go back on truncate.
+// wal_err is set once a group fsync failed
+var wal_mu sync.Mutex
+var wal_cond *sync.Cond = sync.NewCond(&wal_mu)
+var wal *os.File
+var wal_size int64 = 0
+var wal_records int = 0
+var wal_written int64 = 0
+var wal_synced int64 = 0
+var wal_err error = nil
+
+type wal_record struct {
+	Ts     int            `json:"ts"`
+	Writes map[string]any `json:"writes"`
+}
+
+type snapshot_file struct {
+	Clock    int              `json:"clock"`
+	Versions map[string][]any `json:"versions"` // key -> [ts, val]
+}
+
+func get_wal_path() string {
+	return filepath.Join(data_dir, node.ID(), "wal.log")
+}
+
+func get_snapshot_path() string {
+	return filepath.Join(data_dir, node.ID(), "snapshot.json")
+}
+
+func encode_record(record wal_record) ([]byte, error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, wal_header_size, wal_header_size+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	return append(frame, payload...), nil
+}
+
+/*
+Decodes the records at the start of data.
+Returns the records and the length of the valid prefix, everything after it is a torn write.
+*/
+func decode_records(data []byte) ([]wal_record, int64) {
+	records := make([]wal_record, 0)
+	var offset int64 = 0
+	for int64(len(data))-offset >= wal_header_size {
+		header := data[offset : offset+wal_header_size]
+		length := int64(binary.BigEndian.Uint32(header[0:4]))
+		checksum := binary.BigEndian.Uint32(header[4:8])
+		if int64(len(data))-offset-wal_header_size < length {
+			break
+		}
+		payload := data[offset+wal_header_size : offset+wal_header_size+length]
+		if crc32.ChecksumIEEE(payload) != checksum {
+			break
+		}
+		var record wal_record
+		if json.Unmarshal(payload, &record) != nil {
+			break
+		}
+		records = append(records, record)
+		offset += wal_header_size + length
+	}
+	return records, offset
+}
+
+/*
+Appends a commit record, must be called with rw held so records are in commit order.
+Returns the log position a reply has to wait for.
+*/
+func log_commit(ts int, writes map[string]any) (int64, error) {
+	if wal == nil {
+		return 0, nil
+	}
+	frame, err := encode_record(wal_record{ts, writes})
+	if err != nil {
+		return 0, err
+	}
+
+	wal_mu.Lock()
+	defer wal_mu.Unlock()
+	if wal_err != nil {
+		return 0, wal_err
+	}
+	_, err = wal.Write(frame)
+	if err == nil && fsync_policy == fsync_always {
+		err = wal.Sync()
+	}
+	if err != nil {
+		// drop the record, the txn fails and recovery must not replay it
+		wal.Truncate(wal_size)
+		return 0, err
+	}
+	wal_size += int64(len(frame))
+	wal_written += int64(len(frame))
+	wal_records++
+	if fsync_policy == fsync_always {
+		wal_synced = wal_written
+	}
+	return wal_written, nil
+}
+
+// log position after every commit installed so far, must be called with rw held
+func get_log_position() int64 {
+	if wal == nil {
+		return 0
+	}
+	wal_mu.Lock()
+	defer wal_mu.Unlock()
+	return wal_written
+}
+
+// blocks until the log is synced up to position, only the batch policy waits. fails if a group fsync failed
+func wait_durable(position int64) error {
+	if wal == nil || fsync_policy != fsync_batch {
+		return nil
+	}
+	wal_mu.Lock()
+	defer wal_mu.Unlock()
+	for wal_synced < position && wal_err == nil {
+		wal_cond.Wait()
+	}
+	if wal_synced < position {
+		return wal_err
+	}
+	return nil
+}
+
+func sync_wal() {
+	wal_mu.Lock()
+	target := wal_written
+	if wal_synced >= target || wal_err != nil {
+		wal_mu.Unlock()
+		return
+	}
+	wal_mu.Unlock()
+
+	err := wal.Sync()
+	if err != nil {
+		log.Printf("ERROR syncing write-ahead log, no longer serving txns: %s", err)
+		wal_mu.Lock()
+		wal_err = maelstrom.NewRPCError(maelstrom.Crash, "write-ahead log failed to sync: "+err.Error())
+		wal_cond.Broadcast()
+		wal_mu.Unlock()
+		return
+	}
+
+	wal_mu.Lock()
+	wal_synced = max(wal_synced, target)
+	wal_cond.Broadcast()
+	wal_mu.Unlock()
+}
+
+// writes the latest version of every key to a new snapshot and truncates the log
+func take_snapshot() error {
+	rw.Lock()
+	defer rw.Unlock()
+	wal_mu.Lock()
+	err := wal_err
+	wal_mu.Unlock()
+	if err != nil {
+		// the store holds commits that failed to sync
+		return err
+	}
+
+	snap := snapshot_file{clock, make(map[string][]any)}
+	for n := store.first(nil); n != nil; n = n.next[0] {
+		if len(n.versions) == 0 {
+			continue
+		}
+		newest := n.versions[len(n.versions)-1]
+		snap.Versions[n.id] = []any{newest.ts, newest.val}
+	}
+	buf, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	path := get_snapshot_path()
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	// every record is covered by the snapshot now, commits waiting on a sync can go
+	wal_mu.Lock()
+	defer wal_mu.Unlock()
+	err = wal.Truncate(0)
+	if err != nil {
+		return err
+	}
+	wal.Sync()
+	wal_size = 0
+	wal_records = 0
+	wal_synced = wal_written
+	wal_cond.Broadcast()
+	return nil
+}
+
+// loads the latest snapshot and replays the log tail, must run before the node serves txns
+func recover_store() error {
+	err := os.MkdirAll(filepath.Join(data_dir, node.ID()), 0o755)
+	if err != nil {
+		return err
+	}
+
+	buf, err := os.ReadFile(get_snapshot_path())
+	if err == nil {
+		var snap snapshot_file
+		err = json.Unmarshal(buf, &snap)
+		if err != nil {
+			return err
+		}
+		clock = snap.Clock
+		for key, item := range snap.Versions {
+			n := store.get_or_insert(decode_key(key), key)
+			n.versions = []version{{int(item[0].(float64)), item[1]}}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	wal, err = os.OpenFile(get_wal_path(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(wal)
+	if err != nil {
+		return err
+	}
+
+	records, valid := decode_records(data)
+	for _, record := range records {
+		if record.Ts <= clock {
+			// already in the snapshot
+			continue
+		}
+		clock = record.Ts
+		for key, val := range record.Writes {
+			n := store.get_or_insert(decode_key(key), key)
+			n.versions = append(n.versions, version{record.Ts, val})
+		}
+	}
+	if valid < int64(len(data)) {
+		log.Printf("Truncating write-ahead log at offset %d, %d bytes of a torn record", valid, int64(len(data))-valid)
+		err = wal.Truncate(valid)
+		if err != nil {
+			return err
+		}
+	}
+
+	wal_size = valid
+	wal_records = len(records)
+	log.Printf("Recovered %d keys at commit %d", store.len(), clock)
+	reset_change_log(clock)
+	init_wal_routines()
+	return nil
+}
+
+func init_wal_routines() {
+	if fsync_policy == fsync_batch {
+		go func() {
+			for {
+				time.Sleep(fsync_interval)
+				sync_wal()
+			}
+		}()
+	}
+
+	go func() {
+		for {
+			time.Sleep(snapshot_check_interval)
+			wal_mu.Lock()
+			due := wal_records >= snapshot_every
+			wal_mu.Unlock()
+			if !due {
+				continue
+			}
+			err := take_snapshot()
+			if err != nil {
+				log.Printf("ERROR taking snapshot: %s", err)
+			}
+		}
+	}()
+}
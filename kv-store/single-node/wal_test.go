@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func get_test_records() []wal_record {
+	records := make([]wal_record, 0)
+	for i := 1; i <= 5; i++ {
+		writes := make(map[string]any)
+		for j := 0; j < i; j++ {
+			writes[get_id(fmt.Sprintf("key-%d", j))] = float64(i * j)
+		}
+		records = append(records, wal_record{i, writes})
+	}
+	return records
+}
+
+// every cut of the log decodes to the records that end at or before it
+func TestDecodeTruncated(t *testing.T) {
+	records := get_test_records()
+	var data []byte
+	ends := []int64{0}
+	for _, record := range records {
+		frame, err := encode_record(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, frame...)
+		ends = append(ends, int64(len(data)))
+	}
+
+	for cut := 0; cut <= len(data); cut++ {
+		whole := 0
+		for whole+1 < len(ends) && ends[whole+1] <= int64(cut) {
+			whole++
+		}
+		decoded, valid := decode_records(data[:cut])
+		if valid != ends[whole] {
+			t.Fatalf("cut at %d: valid length %d, want %d", cut, valid, ends[whole])
+		}
+		if !reflect.DeepEqual(decoded, records[:whole]) {
+			t.Fatalf("cut at %d: decoded %d records, want the first %d", cut, len(decoded), whole)
+		}
+	}
+}
+
+// a record that fails its checksum ends the log
+func TestDecodeCorrupt(t *testing.T) {
+	records := get_test_records()
+	var data []byte
+	var second int
+	for i, record := range records {
+		frame, err := encode_record(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 {
+			second = len(data)
+		}
+		data = append(data, frame...)
+	}
+
+	data[second+wal_header_size] ^= 0xff
+	decoded, valid := decode_records(data)
+	if valid != int64(second) || len(decoded) != 1 {
+		t.Fatalf("decoded %d records up to %d, want 1 up to %d", len(decoded), valid, second)
+	}
+}
+
+// waits until the publisher took every commit, it reads the log while waiting on one
+func drain_feed() {
+	for {
+		rw.RLock()
+		target := clock
+		rw.RUnlock()
+		watch_mu.Lock()
+		done := published >= target
+		watch_mu.Unlock()
+		wal_mu.Lock()
+		// the publisher drops commits that failed to sync
+		failed := wal_err != nil && len(feed) == 0
+		wal_mu.Unlock()
+		if done || failed {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// drops the in-memory store and closes the log, as if the node crashed
+func crash() {
+	// commits still waiting on a group fsync would keep the publisher waiting
+	if wal != nil {
+		sync_wal()
+	}
+	drain_feed()
+	rw.Lock()
+	defer rw.Unlock()
+	wal_mu.Lock()
+	defer wal_mu.Unlock()
+	if wal != nil {
+		wal.Close()
+		wal = nil
+	}
+	store = new_skiplist()
+	clock = 0
+	wal_size = 0
+	wal_records = 0
+	wal_err = nil
+}
+
+func open_store(t *testing.T) string {
+	crash()
+	isolation = serializable
+	fsync_policy = fsync_always
+	data_dir = t.TempDir()
+	t.Cleanup(crash)
+	err := recover_store()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return get_wal_path()
+}
+
+func commit_writes(t *testing.T, writes map[string]any) {
+	tx := begin_txn(isolation)
+	for key, val := range writes {
+		tx.write(get_id(key), val)
+	}
+	err := tx.commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func check_store(t *testing.T, want_clock int, want map[string]any) {
+	rw.RLock()
+	defer rw.RUnlock()
+	if clock != want_clock {
+		t.Errorf("recovered at commit %d, want %d", clock, want_clock)
+	}
+	for key, val := range want {
+		v, ok := read_at(get_id(key), latest)
+		if !ok || !reflect.DeepEqual(v.val, val) {
+			t.Errorf("%s is %v, want %v", key, v.val, val)
+		}
+	}
+}
+
+// appends a torn record to the log, recovery must drop it and truncate the file
+func tear_log(t *testing.T, path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := encode_record(wal_record{1000, map[string]any{get_id("x"): float64(1000)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(frame[:len(frame)-3])
+	f.Close()
+	return info.Size()
+}
+
+func TestRecoverLog(t *testing.T) {
+	path := open_store(t)
+	commit_writes(t, map[string]any{"x": float64(1), "y": "a"})
+	commit_writes(t, map[string]any{"x": float64(2)})
+	commit_writes(t, map[string]any{"z": []any{float64(1), float64(2)}})
+
+	crash()
+	size := tear_log(t, path)
+	err := recover_store()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check_store(t, 3, map[string]any{"x": float64(2), "y": "a", "z": []any{float64(1), float64(2)}})
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != size {
+		t.Errorf("log is %d bytes after recovery, want the torn record cut at %d", info.Size(), size)
+	}
+
+	// the log stays usable after recovery
+	commit_writes(t, map[string]any{"y": "b"})
+	crash()
+	err = recover_store()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check_store(t, 4, map[string]any{"x": float64(2), "y": "b"})
+}
+
+func TestRecoverSnapshot(t *testing.T) {
+	path := open_store(t)
+	commit_writes(t, map[string]any{"x": float64(1), "y": float64(1)})
+	commit_writes(t, map[string]any{"x": float64(2)})
+	err := take_snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit_writes(t, map[string]any{"y": float64(3)})
+
+	crash()
+	tear_log(t, path)
+	err = recover_store()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check_store(t, 3, map[string]any{"x": float64(2), "y": float64(3)})
+}
+
+// records the snapshot already covers are skipped, as after a crash between its rename and the log truncate
+func TestRecoverSnapshotBeforeTruncate(t *testing.T) {
+	path := open_store(t)
+	commit_writes(t, map[string]any{"x": float64(1)})
+	commit_writes(t, map[string]any{"x": float64(2), "y": float64(2)})
+	logged, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = take_snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crash()
+	err = os.WriteFile(path, logged, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = recover_store()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check_store(t, 2, map[string]any{"x": float64(2), "y": float64(2)})
+
+	rw.RLock()
+	versions := len(store.get(get_id("x")).versions)
+	rw.RUnlock()
+	if versions != 1 {
+		t.Errorf("x has %d versions, records in the snapshot were replayed", versions)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, logged) {
+		t.Errorf("log changed on recovery")
+	}
+}
+
+// runs fn in the background, the returned channel gets its result
+func start(fn func() error) chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	return done
+}
+
+func check_waiting(t *testing.T, done chan error) {
+	t.Helper()
+	select {
+	case err := <-done:
+		t.Fatalf("txn returned %v before the group fsync", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+// under batch, a commit and a read-only txn that read it both wait for the group fsync
+func TestBatchWaitsForSync(t *testing.T) {
+	open_store(t)
+	fsync_policy = fsync_batch
+	t.Cleanup(func() {
+		fsync_policy = fsync_always
+	})
+
+	writer := start(func() error {
+		tx := begin_txn(isolation)
+		tx.write(get_id("x"), float64(1))
+		return tx.commit()
+	})
+	for {
+		rw.RLock()
+		installed := clock == 1
+		rw.RUnlock()
+		if installed {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	reader := start(func() error {
+		_, err := run_txn([]any{[]any{"r", "x", nil}})
+		return err
+	})
+	check_waiting(t, writer)
+	check_waiting(t, reader)
+
+	sync_wal()
+	for _, done := range []chan error{writer, reader} {
+		err := <-done
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// a failed group fsync fails the waiting txns and every later one
+func TestBatchSyncFailure(t *testing.T) {
+	open_store(t)
+	fsync_policy = fsync_batch
+	t.Cleanup(func() {
+		fsync_policy = fsync_always
+	})
+
+	writer := start(func() error {
+		_, err := run_txn([]any{[]any{"w", "x", float64(1)}})
+		return err
+	})
+	check_waiting(t, writer)
+
+	// a closed log fails to sync
+	wal.Close()
+	sync_wal()
+	err := <-writer
+	if err == nil {
+		t.Fatal("commit succeeded after its fsync failed")
+	}
+	_, err = run_txn([]any{[]any{"r", "x", nil}})
+	if err == nil {
+		t.Error("read-only txn succeeded after a failed fsync")
+	}
+	_, err = run_txn([]any{[]any{"w", "y", float64(1)}})
+	if err == nil {
+		t.Error("commit succeeded after a failed fsync")
+	}
+}
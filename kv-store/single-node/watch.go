@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+/*
+----- Watches -----
+
+A client watches either a key or a prefix of string keys and is sent a watch_event for every
+committed txn that changes a watched key. The revision of an event is the commit
+timestamp of the txn, so revisions of one watch are increasing.
+
+Commits are published in commit order by a single routine, once they are as durable
+as the fsync policy asks for. Published commits are kept in a change log of the last
+change_log_size commits, a watch with from_revision first gets every logged commit
+after that revision, so a subscriber can resume from the last revision it saw.
+A from_revision older than the change log fails with precondition-failed and the
+subscriber has to read the keys again with a txn.
+
+Watches and the change log live in memory, a restarted node starts a new change log.
+*/
+
+const change_log_size = 10000
+
+type change struct {
+	revision int
+	writes   map[string]any // encoded key -> value
+	offset   int64          // end of the commit record in the write-ahead log
+}
+
+type watch struct {
+	id     int
+	client string
+	key    string // encoded key, "" for a prefix watch
+	prefix *string
+}
+
+// guarded by watch_mu. compacted is the latest revision that isn't in the change log
+var watch_mu sync.Mutex
+var watches map[int]*watch = make(map[int]*watch)
+var next_watch_id int = 0
+var change_log []change = make([]change, 0)
+var compacted int = 0
+var published int = 0
+
+// commits waiting to be published, in commit order
+var feed chan change = make(chan change, 1024)
+
+func (w *watch) matches(key string) bool {
+	if w.prefix == nil {
+		return w.key == key
+	}
+	raw, ok := decode_key(key).(string)
+	return ok && strings.HasPrefix(raw, *w.prefix)
+}
+
+// the changes of c that w watches as [[key, val], ...] in key order, nil if there are none
+func (w *watch) get_changes(c change) []any {
+	keys := make([]any, 0)
+	for key := range c.writes {
+		if w.matches(key) {
+			keys = append(keys, decode_key(key))
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return compare_keys(keys[i], keys[j]) < 0
+	})
+	changes := make([]any, 0, len(keys))
+	for _, key := range keys {
+		id, _ := encode_key(key)
+		changes = append(changes, []any{key, c.writes[id]})
+	}
+	return changes
+}
+
+// must be called with watch_mu held
+func notify(w *watch, c change) {
+	changes := w.get_changes(c)
+	if changes == nil {
+		return
+	}
+	var body map[string]any = make(map[string]any)
+	body["type"] = "watch_event"
+	body["watch_id"] = w.id
+	body["revision"] = c.revision
+	body["changes"] = changes
+	node.Send(w.client, body)
+}
+
+// queues a commit for publishing, must be called with rw held so commits are queued in order
+func queue_change(revision int, writes map[string]any, offset int64) {
+	feed <- change{revision, writes, offset}
+}
+
+func init_publish_routine() {
+	go func() {
+		for c := range feed {
+			if wait_durable(c.offset) != nil {
+				// failed to sync, the node no longer serves txns
+				continue
+			}
+
+			watch_mu.Lock()
+			change_log = append(change_log, c)
+			if len(change_log) > change_log_size {
+				compacted = change_log[0].revision
+				change_log = change_log[1:]
+			}
+			published = c.revision
+			for _, w := range watches {
+				notify(w, c)
+			}
+			watch_mu.Unlock()
+		}
+	}()
+}
+
+// starts the change log after the recovered commits, which it doesn't hold
+func reset_change_log(revision int) {
+	watch_mu.Lock()
+	defer watch_mu.Unlock()
+	compacted = revision
+	published = revision
+}
+
+func handle_watch(msg maelstrom.Message) error {
+	body, err := get_body_from_msg(msg)
+	if err != nil {
+		return err
+	}
+
+	_, has_key := body["key"]
+	_, has_prefix := body["prefix"]
+	if has_key == has_prefix {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, "a watch needs either a key or a prefix")
+	}
+
+	w := &watch{client: msg.Src}
+	if has_prefix {
+		str, ok := body["prefix"].(string)
+		if !ok {
+			return maelstrom.NewRPCError(maelstrom.MalformedRequest, "prefix must be a string")
+		}
+		w.prefix = &str
+	} else {
+		w.key, err = encode_key(body["key"])
+		if err != nil {
+			return err
+		}
+	}
+
+	watch_mu.Lock()
+	defer watch_mu.Unlock()
+	if from, ok := body["from_revision"].(float64); ok {
+		if int(from) < compacted {
+			return maelstrom.NewRPCError(maelstrom.PreconditionFailed, fmt.Sprintf("revision %d is compacted, the change log starts after %d", int(from), compacted))
+		}
+		// reply first so the subscriber knows the watch id before its events
+		defer func() {
+			for _, c := range change_log {
+				if c.revision > int(from) {
+					notify(w, c)
+				}
+			}
+		}()
+	}
+	next_watch_id++
+	w.id = next_watch_id
+	watches[w.id] = w
+
+	body["type"] = "watch_ok"
+	body["watch_id"] = w.id
+	body["revision"] = published
+	return node.Reply(msg, body)
+}
+
+func handle_unwatch(msg maelstrom.Message) error {
+	body, err := get_body_from_msg(msg)
+	if err != nil {
+		return err
+	}
+
+	id, _ := body["watch_id"].(float64)
+	watch_mu.Lock()
+	delete(watches, int(id))
+	watch_mu.Unlock()
+
+	var reply map[string]any = make(map[string]any)
+	reply["type"] = "unwatch_ok"
+	return node.Reply(msg, reply)
+}
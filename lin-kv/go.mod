@@ -0,0 +1,5 @@
+module maelstrom-lin-kv
+
+go 1.22.3
+
+require github.com/jepsen-io/maelstrom/demo/go v0.0.0-20240408130303-0186f398f965
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+/*
+
+Strategy:
+
+A linearizable key-value store replicated with Raft.
+It serves the same read, write and cas RPCs as Maelstrom's built-in lin-kv.
+
+- Nodes elect a leader with randomized election timeouts (request_vote)
+- The leader appends every client op to its log and replicates it (append_entries)
+- An entry is committed once a majority stores it, committed entries are
+  applied to the state machine in log order
+- The leader replies to the client after the op is applied
+- Followers forward client ops to the leader they know of and relay its reply
+
+Reads go through the log as well, so a deposed leader can't serve a stale read.
+
+Note:
+-----
+
+Raft state is kept in memory only. Maelstrom's lin-kv workload partitions the
+network but doesn't restart nodes, so persisting term, vote and log is skipped.
+
+*/
+
+// GLOBALS
+var node *maelstrom.Node
+var mu sync.Mutex
+
+const follower string = "follower"
+const candidate string = "candidate"
+const leader string = "leader"
+
+const heartbeat_interval = 50 * time.Millisecond
+const election_timeout = 300 * time.Millisecond
+const request_timeout = 1 * time.Second
+const max_batch = 100
+
+type log_entry struct {
+	Term int            `json:"term"`
+	Op   map[string]any `json:"op"`
+}
+
+// raft state, guarded by mu
+var role string = follower
+var current_term int = 0
+var voted_for string = ""
+var leader_id string = ""
+var entries []log_entry = []log_entry{{0, nil}} // index 0 is a sentinel, the log starts at 1
+var commit_index int = 0
+var last_applied int = 0
+var last_heartbeat time.Time = time.Now()
+var timeout time.Duration = get_election_timeout()
+
+// leader state
+var next_index map[string]int = make(map[string]int)
+var match_index map[string]int = make(map[string]int)
+
+// state machine, keys are json encoded
+var kv map[string]any = make(map[string]any)
+
+type result struct {
+	body map[string]any
+	err  error
+}
+
+// clients waiting for their op to be applied, by request id
+var waiting map[string]chan result = make(map[string]chan result)
+var next_request int = 0
+
+/*
+-----------
+   Utils
+-----------
+*/
+
+func get_body_from_msg(msg maelstrom.Message) (map[string]any, error) {
+	var body map[string]any
+	err := json.Unmarshal(msg.Body, &body)
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func get_election_timeout() time.Duration {
+	return election_timeout + time.Duration(rand.Int63n(int64(election_timeout)))
+}
+
+func encode(value any) string {
+	buf, _ := json.Marshal(value)
+	return string(buf)
+}
+
+func majority() int {
+	return len(node.NodeIDs())/2 + 1
+}
+
+func last_log_index() int {
+	return len(entries) - 1
+}
+
+func last_log_term() int {
+	return entries[len(entries)-1].Term
+}
+
+func get_entries_from_body(raw any) []log_entry {
+	var result []log_entry
+	buf, _ := json.Marshal(raw)
+	json.Unmarshal(buf, &result)
+	return result
+}
+
+// must be called with mu held
+func step_down(term int) {
+	if term > current_term {
+		current_term = term
+		voted_for = ""
+	}
+	role = follower
+}
+
+/*
+------------------
+   State Machine
+------------------
+*/
+
+func apply(op map[string]any) result {
+	key := encode(op["key"])
+	current, ok := kv[key]
+	reply := make(map[string]any)
+
+	switch op["type"] {
+	case "read":
+		if !ok {
+			return result{nil, maelstrom.NewRPCError(maelstrom.KeyDoesNotExist, "key does not exist")}
+		}
+		reply["type"] = "read_ok"
+		reply["value"] = current
+	case "write":
+		kv[key] = op["value"]
+		reply["type"] = "write_ok"
+	case "cas":
+		if !ok {
+			create, _ := op["create_if_not_exists"].(bool)
+			if !create {
+				return result{nil, maelstrom.NewRPCError(maelstrom.KeyDoesNotExist, "key does not exist")}
+			}
+		} else if encode(current) != encode(op["from"]) {
+			text := fmt.Sprintf("expected %s, but had %s", encode(op["from"]), encode(current))
+			return result{nil, maelstrom.NewRPCError(maelstrom.PreconditionFailed, text)}
+		}
+		kv[key] = op["to"]
+		reply["type"] = "cas_ok"
+	}
+	return result{reply, nil}
+}
+
+// applies committed entries in log order, must be called with mu held
+func apply_committed() {
+	for last_applied < commit_index {
+		last_applied++
+		op := entries[last_applied].Op
+		res := apply(op)
+		id, _ := op["request_id"].(string)
+		if ch, ok := waiting[id]; ok {
+			delete(waiting, id)
+			ch <- res
+		}
+	}
+}
+
+/*
+--------------
+   Election
+--------------
+*/
+
+func start_election() {
+	mu.Lock()
+	role = candidate
+	current_term++
+	voted_for = node.ID()
+	leader_id = ""
+	last_heartbeat = time.Now()
+	timeout = get_election_timeout()
+	term := current_term
+	votes := 1
+
+	body := make(map[string]any)
+	body["type"] = "request_vote"
+	body["term"] = term
+	body["candidate_id"] = node.ID()
+	body["last_log_index"] = last_log_index()
+	body["last_log_term"] = last_log_term()
+	if votes >= majority() {
+		// single node cluster
+		become_leader()
+	}
+	mu.Unlock()
+
+	log.Printf("Starting election for term %d", term)
+	for _, vertex := range node.NodeIDs() {
+		if vertex == node.ID() {
+			continue
+		}
+		node.RPC(vertex, body, func(msg maelstrom.Message) error {
+			reply, err := get_body_from_msg(msg)
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+
+			reply_term := int(reply["term"].(float64))
+			if reply_term > current_term {
+				step_down(reply_term)
+				return nil
+			}
+			if role != candidate || current_term != term || !reply["vote_granted"].(bool) {
+				return nil
+			}
+			votes++
+			if votes >= majority() {
+				become_leader()
+			}
+			return nil
+		})
+	}
+}
+
+// must be called with mu held
+func become_leader() {
+	log.Printf("Became leader for term %d", current_term)
+	role = leader
+	leader_id = node.ID()
+	for _, vertex := range node.NodeIDs() {
+		next_index[vertex] = last_log_index() + 1
+		match_index[vertex] = 0
+	}
+	go replicate()
+}
+
+/*
+-----------------
+   Replication
+-----------------
+*/
+
+func replicate() {
+	mu.Lock()
+	defer mu.Unlock()
+	if role != leader {
+		return
+	}
+	term := current_term
+	advance_commit_index()
+
+	for _, vertex := range node.NodeIDs() {
+		if vertex == node.ID() {
+			continue
+		}
+		prev := next_index[vertex] - 1
+		end := min(last_log_index()+1, next_index[vertex]+max_batch)
+		batch := append([]log_entry(nil), entries[prev+1:end]...)
+
+		body := make(map[string]any)
+		body["type"] = "append_entries"
+		body["term"] = term
+		body["leader_id"] = node.ID()
+		body["prev_log_index"] = prev
+		body["prev_log_term"] = entries[prev].Term
+		body["entries"] = batch
+		body["leader_commit"] = commit_index
+
+		node.RPC(vertex, body, func(msg maelstrom.Message) error {
+			reply, err := get_body_from_msg(msg)
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+
+			reply_term := int(reply["term"].(float64))
+			if reply_term > current_term {
+				step_down(reply_term)
+				return nil
+			}
+			if role != leader || current_term != term {
+				return nil
+			}
+			if reply["success"].(bool) {
+				match := prev + len(batch)
+				match_index[vertex] = max(match_index[vertex], match)
+				next_index[vertex] = match_index[vertex] + 1
+				advance_commit_index()
+			} else if prev == next_index[vertex]-1 {
+				// back off to the follower's log end, it can't be ahead of prev.
+				// a failure for an older prev is stale, acting on it could back off below the match point
+				hint := int(reply["last_log_index"].(float64)) + 1
+				next_index[vertex] = max(1, min(next_index[vertex]-1, hint))
+			}
+			return nil
+		})
+	}
+}
+
+// commits the highest index of the current term stored on a majority, must be called with mu held
+func advance_commit_index() {
+	for n := last_log_index(); n > commit_index; n-- {
+		if entries[n].Term != current_term {
+			break
+		}
+		count := 1
+		for _, vertex := range node.NodeIDs() {
+			if vertex != node.ID() && match_index[vertex] >= n {
+				count++
+			}
+		}
+		if count >= majority() {
+			commit_index = n
+			apply_committed()
+			break
+		}
+	}
+}
+
+func init_raft_routines() {
+	go func() {
+		for {
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			expired := role != leader && len(node.NodeIDs()) > 0 && time.Since(last_heartbeat) > timeout
+			mu.Unlock()
+			if expired {
+				start_election()
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			time.Sleep(heartbeat_interval)
+			replicate()
+		}
+	}()
+}
+
+/*
+------------------
+   RPC Handlers
+------------------
+*/
+
+func handle_request_vote(msg maelstrom.Message) error {
+	body, err := get_body_from_msg(msg)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+
+	term := int(body["term"].(float64))
+	if term > current_term {
+		step_down(term)
+	}
+
+	candidate_id := body["candidate_id"].(string)
+	candidate_last_index := int(body["last_log_index"].(float64))
+	candidate_last_term := int(body["last_log_term"].(float64))
+	up_to_date := candidate_last_term > last_log_term() ||
+		(candidate_last_term == last_log_term() && candidate_last_index >= last_log_index())
+
+	granted := false
+	if term == current_term && (voted_for == "" || voted_for == candidate_id) && up_to_date {
+		voted_for = candidate_id
+		granted = true
+		last_heartbeat = time.Now()
+	}
+
+	reply := make(map[string]any)
+	reply["type"] = "request_vote_ok"
+	reply["term"] = current_term
+	reply["vote_granted"] = granted
+	return node.Reply(msg, reply)
+}
+
+func handle_append_entries(msg maelstrom.Message) error {
+	body, err := get_body_from_msg(msg)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+
+	reply := make(map[string]any)
+	reply["type"] = "append_entries_ok"
+	reply["success"] = false
+
+	term := int(body["term"].(float64))
+	if term < current_term {
+		reply["term"] = current_term
+		reply["last_log_index"] = last_log_index()
+		return node.Reply(msg, reply)
+	}
+	step_down(term)
+	leader_id = body["leader_id"].(string)
+	last_heartbeat = time.Now()
+
+	prev := int(body["prev_log_index"].(float64))
+	prev_term := int(body["prev_log_term"].(float64))
+	if prev > last_log_index() || entries[prev].Term != prev_term {
+		reply["term"] = current_term
+		reply["last_log_index"] = min(last_log_index(), prev-1)
+		return node.Reply(msg, reply)
+	}
+
+	// truncate only on a conflict, a stale append must not drop newer entries
+	batch := get_entries_from_body(body["entries"])
+	for i, e := range batch {
+		index := prev + 1 + i
+		if index <= last_log_index() {
+			if entries[index].Term == e.Term {
+				continue
+			}
+			entries = entries[:index]
+		}
+		entries = append(entries, e)
+	}
+
+	leader_commit := int(body["leader_commit"].(float64))
+	if leader_commit > commit_index {
+		// entries past the batch may be stale ones of an old term, only the batch is known to match the leader
+		commit_index = max(commit_index, min(leader_commit, prev+len(batch)))
+		apply_committed()
+	}
+
+	reply["term"] = current_term
+	reply["success"] = true
+	return node.Reply(msg, reply)
+}
+
+// handles read, write and cas from clients
+func handle_client_op(msg maelstrom.Message) error {
+	body, err := get_body_from_msg(msg)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	if role != leader {
+		target := leader_id
+		mu.Unlock()
+		if target == "" {
+			return maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable, "no leader known")
+		}
+		return forward(msg, target, body)
+	}
+
+	next_request++
+	id := fmt.Sprintf("%s_%d", node.ID(), next_request)
+	body["request_id"] = id
+	ch := make(chan result, 1)
+	waiting[id] = ch
+	entries = append(entries, log_entry{current_term, body})
+	mu.Unlock()
+
+	go replicate()
+
+	select {
+	case res := <-ch:
+		if res.err != nil {
+			return res.err
+		}
+		return node.Reply(msg, res.body)
+	case <-time.After(request_timeout):
+		mu.Lock()
+		delete(waiting, id)
+		mu.Unlock()
+		// the op may still be applied later
+		return maelstrom.NewRPCError(maelstrom.Crash, "op was not committed in time")
+	}
+}
+
+// sends a client op on to the leader and relays its reply
+func forward(msg maelstrom.Message, target string, body map[string]any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), request_timeout)
+	defer cancel()
+	resp, err := node.SyncRPC(ctx, target, body)
+	if err != nil {
+		if _, ok := err.(*maelstrom.RPCError); ok {
+			return err
+		}
+		return maelstrom.NewRPCError(maelstrom.Crash, "leader did not reply in time")
+	}
+	reply, err := get_body_from_msg(resp)
+	if err != nil {
+		return err
+	}
+	delete(reply, "in_reply_to")
+	delete(reply, "msg_id")
+	return node.Reply(msg, reply)
+}
+
+func main() {
+	node = maelstrom.NewNode()
+	node.Handle("read", handle_client_op)
+	node.Handle("write", handle_client_op)
+	node.Handle("cas", handle_client_op)
+	node.Handle("request_vote", handle_request_vote)
+	node.Handle("append_entries", handle_append_entries)
+	init_raft_routines()
+	err := node.Run()
+	if err != nil {
+		log.Fatal(err)
+	}
+}